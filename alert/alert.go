@@ -0,0 +1,238 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * alert evaluates alert rules on all stat records and posts an event to a
+ * webhook, when a rule fires or resolves. AlertConf implements output.Writer,
+ * so it gets all records of the socket feeder as well as of imported files.
+ * As output.StatusWriter it posts the collectors reported down and up again.
+ */
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"nfinflux/nffile"
+	"path"
+	"sync"
+	"time"
+)
+
+// time to wait for the webhook to accept an event
+const webhookTimeout = 10 * time.Second
+
+// Event is posted as JSON to the webhook
+type Event struct {
+	Status    string    `json:"status"`
+	Rule      string    `json:"rule"`
+	Channel   string    `json:"channel"`
+	Exporter  string    `json:"exporter"`
+	Proto     string    `json:"proto"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+type seriesKey struct {
+	rule     int
+	channel  string
+	exporter string
+}
+
+type AlertConf struct {
+	rules   []*Rule
+	webhook string
+	client  *http.Client
+	series  map[seriesKey]*seriesState
+	events  chan Event
+	lock    sync.Mutex
+	errList []error
+	wg      sync.WaitGroup
+	// events dropped, as the webhook did not keep up
+	dropped int
+}
+
+// New creates an alert evaluator for rules, which posts events to the webhook URL
+func New(rules []*Rule, webhook string) (*AlertConf, error) {
+	if len(webhook) == 0 {
+		return nil, fmt.Errorf("alert: no webhook URL")
+	}
+	alertConf := new(AlertConf)
+	alertConf.rules = rules
+	alertConf.webhook = webhook
+	alertConf.client = &http.Client{Timeout: webhookTimeout}
+	alertConf.series = make(map[seriesKey]*seriesState)
+	return alertConf, nil
+} // End of New
+
+func (alertConf *AlertConf) StartWrite() error {
+	alertConf.events = make(chan Event, 64)
+	alertConf.wg.Add(1)
+	go func() {
+		defer alertConf.wg.Done()
+		for event := range alertConf.events {
+			if err := alertConf.post(&event); err != nil {
+				fmt.Printf("alert webhook error: %v\n", err)
+				alertConf.lock.Lock()
+				alertConf.errList = append(alertConf.errList, err)
+				alertConf.lock.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (alertConf *AlertConf) InsertStat(when time.Time, channel string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	for i, rule := range alertConf.rules {
+		if ok, _ := path.Match(rule.channel, channel); !ok {
+			continue
+		}
+		key := seriesKey{i, channel, exporterID}
+		state, ok := alertConf.series[key]
+		if !ok {
+			state = new(seriesState)
+			alertConf.series[key] = state
+		}
+		status, value, threshold := rule.evaluate(state, when, &statRecord)
+		if len(status) == 0 {
+			continue
+		}
+		fmt.Printf("Alert %s: '%s' for '%s', exporter: %s, value: %.0f, threshold: %.0f\n",
+			status, rule, channel, exporterID, value, threshold)
+		alertConf.queue(Event{
+			Status:    status,
+			Rule:      rule.text,
+			Channel:   channel,
+			Exporter:  exporterID,
+			Proto:     rule.proto,
+			Metric:    rule.metric,
+			Value:     value,
+			Threshold: threshold,
+			Time:      when,
+		})
+	}
+}
+
+// InsertStatus posts a collector reported down with the number of missed
+// intervals, or reported up again
+func (alertConf *AlertConf) InsertStatus(when time.Time, channel string, exporterID string, up bool, missed int) {
+	status := "down"
+	if up {
+		status = "up"
+	}
+	alertConf.queue(Event{
+		Status:   status,
+		Rule:     "liveness",
+		Channel:  channel,
+		Exporter: exporterID,
+		Metric:   "missed",
+		Value:    float64(missed),
+		Time:     when,
+	})
+}
+
+// queue an event for the webhook
+func (alertConf *AlertConf) queue(event Event) {
+	if alertConf.events == nil {
+		return
+	}
+	// never stall the ingestion by a slow webhook
+	select {
+	case alertConf.events <- event:
+	default:
+		alertConf.dropped++
+		fmt.Printf("Alert webhook queue full - event dropped\n")
+	}
+}
+
+func (alertConf *AlertConf) post(event *Event) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	// keep the operators of the rule readable
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return err
+	}
+	resp, err := alertConf.client.Post(alertConf.webhook, "application/json", &data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", alertConf.webhook, resp.Status)
+	}
+	return nil
+}
+
+// Takeover continues the state of all rules of the replaced evaluator old
+// on reload, which are unchanged. Changed rules start without state.
+func (alertConf *AlertConf) Takeover(old *AlertConf) {
+	ruleIndex := make(map[string]int)
+	for i, rule := range alertConf.rules {
+		ruleIndex[rule.text] = i
+	}
+	for key, state := range old.series {
+		i, ok := ruleIndex[old.rules[key.rule].text]
+		if !ok {
+			if state.firing {
+				fmt.Printf("Alert rule '%s' removed while firing for '%s', exporter: %s\n", old.rules[key.rule].text, key.channel, key.exporter)
+			}
+			continue
+		}
+		key.rule = i
+		alertConf.series[key] = state
+	}
+}
+
+// EndWrite waits until all pending events are posted
+func (alertConf *AlertConf) EndWrite() error {
+	if alertConf.events != nil {
+		close(alertConf.events)
+		alertConf.wg.Wait()
+		alertConf.events = nil
+	}
+
+	alertConf.lock.Lock()
+	defer alertConf.lock.Unlock()
+	if alertConf.errList != nil {
+		return fmt.Errorf("alert failed webhook posts: %d, dropped events: %d", len(alertConf.errList), alertConf.dropped)
+	}
+	if alertConf.dropped > 0 {
+		return fmt.Errorf("alert dropped events: %d", alertConf.dropped)
+	}
+	return nil
+}
+
+func (alertConf *AlertConf) Close() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"nfinflux/nffile"
+	"testing"
+	"time"
+)
+
+// start a webhook receiver, which answers with status
+func newWebhook(t *testing.T, status int) (*httptest.Server, chan Event) {
+	events := make(chan Event, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		events <- event
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, events
+}
+
+func TestWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"posted", http.StatusOK, false},
+		{"rejected", http.StatusInternalServerError, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, events := newWebhook(t, test.status)
+			rules, err := ParseRules("edge*:udp.pps > 500k for 2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			alertConf, err := New(rules, server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alertConf.StartWrite()
+			start := time.Date(2022, 3, 3, 12, 0, 0, 0, time.UTC)
+			for i, packets := range []uint64{600e3, 700e3, 800e3, 100e3} {
+				when := start.Add(time.Duration(i) * time.Minute)
+				alertConf.InsertStat(when, "edge1", "1", 60, nffile.StatRecord{NumpacketsUdp: packets})
+				// other channels do not match the rule
+				alertConf.InsertStat(when, "core1", "1", 60, nffile.StatRecord{NumpacketsUdp: packets})
+			}
+			err = alertConf.EndWrite()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("EndWrite: %v, want error %v", err, test.wantErr)
+			}
+			close(events)
+
+			want := []Event{
+				{Status: "firing", Rule: "edge*:udp.pps > 500k for 2", Channel: "edge1", Exporter: "1", Proto: "udp", Metric: "pps",
+					Value: 700e3, Threshold: 500e3, Time: start.Add(time.Minute)},
+				{Status: "resolved", Rule: "edge*:udp.pps > 500k for 2", Channel: "edge1", Exporter: "1", Proto: "udp", Metric: "pps",
+					Value: 100e3, Threshold: 500e3, Time: start.Add(3 * time.Minute)},
+			}
+			var got []Event
+			for event := range events {
+				got = append(got, event)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d events, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("event %d: %+v, want %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// collectors reported down and up are posted without any rule
+func TestStatusEvents(t *testing.T) {
+	server, events := newWebhook(t, http.StatusOK)
+	alertConf, err := New(nil, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alertConf.StartWrite()
+	start := time.Date(2022, 3, 3, 12, 0, 0, 0, time.UTC)
+	alertConf.InsertStatus(start, "edge1", "1", false, 3)
+	alertConf.InsertStatus(start.Add(5*time.Minute), "edge1", "1", true, 0)
+	if err := alertConf.EndWrite(); err != nil {
+		t.Fatalf("EndWrite: %v", err)
+	}
+	close(events)
+
+	want := []Event{
+		{Status: "down", Rule: "liveness", Channel: "edge1", Exporter: "1", Metric: "missed", Value: 3, Time: start},
+		{Status: "up", Rule: "liveness", Channel: "edge1", Exporter: "1", Metric: "missed", Value: 0, Time: start.Add(5 * time.Minute)},
+	}
+	var got []Event
+	for event := range events {
+		got = append(got, event)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestInsertAfterEndWrite(t *testing.T) {
+	rules, _ := ParseRules("udp.pps > 10")
+	alertConf, err := New(rules, "http://127.0.0.1:1/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alertConf.StartWrite()
+	alertConf.EndWrite()
+
+	// a firing rule must not block without a running poster
+	done := make(chan bool)
+	go func() {
+		alertConf.InsertStat(time.Now(), "edge1", "1", 60, nffile.StatRecord{NumpacketsUdp: 100})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("InsertStat blocked after EndWrite")
+	}
+}
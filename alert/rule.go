@@ -0,0 +1,259 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * rule parses and evaluates alert rules on the rates/s of the stat records:
+ *   [channel:]proto.metric op value [for n]
+ *   [channel:]proto.metric op percent% avg duration [for n]
+ * e.g. "edge*:udp.pps > 500k for 3" or "tcp.bps < 10% avg 1h".
+ * proto is tcp, udp, icmp, other or total, metric is fps, pps or bps (bits/s).
+ * A rule fires, when it matches n consecutive records of a channel and
+ * exporter and resolves with the first record, which does not match.
+ */
+
+package alert
+
+import (
+	"fmt"
+	"nfinflux/nffile"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Rule struct {
+	text    string
+	channel string
+	proto   string
+	metric  string
+	op      string
+	// absolute threshold or fraction of the average over window
+	threshold float64
+	window    time.Duration
+	count     int
+}
+
+type sample struct {
+	when  time.Time
+	value float64
+}
+
+// state of a rule for a channel and exporter
+type seriesState struct {
+	matches int
+	firing  bool
+	history []sample
+}
+
+// ParseRules parses a comma separated list of rules
+func ParseRules(list string) ([]*Rule, error) {
+	var rules []*Rule
+	for _, text := range strings.Split(list, ",") {
+		if text = strings.TrimSpace(text); len(text) == 0 {
+			continue
+		}
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseRule parses a single rule
+func ParseRule(text string) (*Rule, error) {
+	rule := &Rule{text: text, channel: "*", count: 1}
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid alert rule '%s'", text)
+	}
+
+	selector := fields[0]
+	if i := strings.LastIndex(selector, ":"); i >= 0 {
+		rule.channel = selector[:i]
+		selector = selector[i+1:]
+		if _, err := path.Match(rule.channel, ""); err != nil {
+			return nil, fmt.Errorf("invalid channel pattern in alert rule '%s': %v", text, err)
+		}
+	}
+	proto, metric, ok := strings.Cut(selector, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid metric '%s' in alert rule '%s'", selector, text)
+	}
+	switch proto {
+	case "tcp", "udp", "icmp", "other", "total":
+	default:
+		return nil, fmt.Errorf("unknown proto '%s' in alert rule '%s'", proto, text)
+	}
+	switch metric {
+	case "fps", "pps", "bps":
+	default:
+		return nil, fmt.Errorf("unknown metric '%s' in alert rule '%s'", metric, text)
+	}
+	rule.proto = proto
+	rule.metric = metric
+
+	rule.op = fields[1]
+	if rule.op != ">" && rule.op != "<" {
+		return nil, fmt.Errorf("unknown operator '%s' in alert rule '%s'", rule.op, text)
+	}
+
+	next := 3
+	if percent, ok := strings.CutSuffix(fields[2], "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || len(fields) < 5 || fields[3] != "avg" {
+			return nil, fmt.Errorf("invalid average threshold in alert rule '%s'", text)
+		}
+		if rule.window, err = time.ParseDuration(fields[4]); err != nil || rule.window <= 0 {
+			return nil, fmt.Errorf("invalid average window in alert rule '%s'", text)
+		}
+		rule.threshold = value / 100
+		next = 5
+	} else {
+		value, err := parseValue(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold in alert rule '%s'", text)
+		}
+		rule.threshold = value
+	}
+
+	switch len(fields) - next {
+	case 0:
+	case 2:
+		count, err := strconv.Atoi(fields[next+1])
+		if fields[next] != "for" || err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid interval count in alert rule '%s'", text)
+		}
+		rule.count = count
+	default:
+		return nil, fmt.Errorf("invalid alert rule '%s'", text)
+	}
+	return rule, nil
+} // End of ParseRule
+
+// parse a number with an optional k, M or G suffix
+func parseValue(s string) (float64, error) {
+	factor := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		factor = 1e3
+	case strings.HasSuffix(s, "M"):
+		factor = 1e6
+	case strings.HasSuffix(s, "G"):
+		factor = 1e9
+	}
+	if factor > 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	return value * factor, err
+}
+
+func (rule *Rule) String() string {
+	return rule.text
+}
+
+// value of the rule's metric in a stat record
+func (rule *Rule) value(stat *nffile.StatRecord) float64 {
+	var flows, packets, bytes uint64
+	switch rule.proto {
+	case "tcp":
+		flows, packets, bytes = stat.NumflowsTcp, stat.NumpacketsTcp, stat.NumbytesTcp
+	case "udp":
+		flows, packets, bytes = stat.NumflowsUdp, stat.NumpacketsUdp, stat.NumbytesUdp
+	case "icmp":
+		flows, packets, bytes = stat.NumflowsIcmp, stat.NumpacketsIcmp, stat.NumbytesIcmp
+	case "other":
+		flows, packets, bytes = stat.NumflowsOther, stat.NumpacketsOther, stat.NumbytesOther
+	case "total":
+		flows = stat.NumflowsTcp + stat.NumflowsUdp + stat.NumflowsIcmp + stat.NumflowsOther
+		packets = stat.NumpacketsTcp + stat.NumpacketsUdp + stat.NumpacketsIcmp + stat.NumpacketsOther
+		bytes = stat.NumbytesTcp + stat.NumbytesUdp + stat.NumbytesIcmp + stat.NumbytesOther
+	}
+	switch rule.metric {
+	case "fps":
+		return float64(flows)
+	case "pps":
+		return float64(packets)
+	default:
+		return float64(bytes) * 8
+	}
+}
+
+// evaluate the rule for a new record of a series. Returns "firing" or
+// "resolved", if the state of the rule changed, the value and the threshold.
+func (rule *Rule) evaluate(state *seriesState, when time.Time, stat *nffile.StatRecord) (string, float64, float64) {
+	value := rule.value(stat)
+	threshold := rule.threshold
+
+	if rule.window > 0 {
+		// average of the records within the window before this record
+		var sum float64
+		var num int
+		start := when.Add(-rule.window)
+		for _, s := range state.history {
+			if !s.when.Before(start) && s.when.Before(when) {
+				sum += s.value
+				num++
+			}
+		}
+		// wait until at least half of the window is covered
+		covered := num > 0 && !state.history[0].when.After(when.Add(-rule.window/2))
+		state.history = append(state.history, sample{when, value})
+		for len(state.history) > 0 && state.history[0].when.Before(start) {
+			state.history = state.history[1:]
+		}
+		if !covered {
+			return "", value, 0
+		}
+		threshold = rule.threshold * sum / float64(num)
+	}
+
+	match := value > threshold
+	if rule.op == "<" {
+		match = value < threshold
+	}
+
+	if match {
+		state.matches++
+		if !state.firing && state.matches >= rule.count {
+			state.firing = true
+			return "firing", value, threshold
+		}
+	} else {
+		state.matches = 0
+		if state.firing {
+			state.firing = false
+			return "resolved", value, threshold
+		}
+	}
+	return "", value, threshold
+} // End of evaluate
@@ -0,0 +1,148 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package alert
+
+import (
+	"nfinflux/nffile"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		text string
+		want Rule
+	}{
+		{"udp.pps > 500k", Rule{channel: "*", proto: "udp", metric: "pps", op: ">", threshold: 500e3, count: 1}},
+		{"edge*:tcp.bps > 1.5G for 3", Rule{channel: "edge*", proto: "tcp", metric: "bps", op: ">", threshold: 1.5e9, count: 3}},
+		{"site:edge1:total.fps < 10", Rule{channel: "site:edge1", proto: "total", metric: "fps", op: "<", threshold: 10, count: 1}},
+		{"tcp.bps < 10% avg 1h", Rule{channel: "*", proto: "tcp", metric: "bps", op: "<", threshold: 0.1, window: time.Hour, count: 1}},
+		{"icmp.pps > 300% avg 30m for 2", Rule{channel: "*", proto: "icmp", metric: "pps", op: ">", threshold: 3, window: 30 * time.Minute, count: 2}},
+		{"other.fps > 2M", Rule{channel: "*", proto: "other", metric: "fps", op: ">", threshold: 2e6, count: 1}},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.text)
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", test.text, err)
+			continue
+		}
+		test.want.text = test.text
+		if *rule != test.want {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", test.text, *rule, test.want)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	for _, text := range []string{
+		"udp.pps >",
+		"udp.pps = 10",
+		"udp > 10",
+		"sctp.pps > 10",
+		"udp.kbps > 10",
+		"udp.pps > 10x",
+		"edge[:udp.pps > 10",
+		"udp.pps > 10 for 0",
+		"udp.pps > 10 for",
+		"udp.pps > 10 during 3",
+		"udp.pps > 10% 1h",
+		"udp.pps > 10% avg 0s",
+		"udp.pps > x% avg 1h",
+		"udp.pps > 10% avg 1h for 2 x",
+	} {
+		if _, err := ParseRule(text); err == nil {
+			t.Errorf("ParseRule(%q) accepted an invalid rule", text)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("udp.pps > 500k for 3, , tcp.bps < 10% avg 1h")
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("ParseRules: %d rules, %v", len(rules), err)
+	}
+	if _, err := ParseRules("udp.pps > 500k, tcp.bps <"); err == nil {
+		t.Errorf("ParseRules accepted an invalid rule")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	type step struct {
+		// minutes since the first record and tcp packets/s
+		minute  int
+		packets uint64
+		status  string
+	}
+	tests := []struct {
+		rule  string
+		steps []step
+	}{
+		{"tcp.pps > 100", []step{
+			{0, 50, ""}, {1, 150, "firing"}, {2, 200, ""}, {3, 100, "resolved"}, {4, 50, ""},
+		}},
+		{"tcp.pps > 100 for 3", []step{
+			{0, 150, ""}, {1, 150, ""}, {2, 50, ""},
+			{3, 150, ""}, {4, 150, ""}, {5, 150, "firing"}, {6, 150, ""}, {7, 50, "resolved"},
+		}},
+		{"tcp.pps < 10", []step{
+			{0, 50, ""}, {1, 5, "firing"}, {2, 50, "resolved"},
+		}},
+		{"tcp.bps > 800", []step{
+			{0, 50, ""}, {1, 150, "firing"},
+		}},
+		// the average is used, once half of the window is covered
+		{"tcp.pps < 50% avg 10m", []step{
+			{0, 100, ""}, {1, 10, ""}, {2, 100, ""}, {3, 100, ""}, {4, 100, ""},
+			{5, 100, ""}, {6, 20, "firing"}, {7, 100, "resolved"},
+		}},
+		// records older than the window leave the average
+		{"tcp.pps > 200% avg 2m", []step{
+			{0, 1000, ""}, {1, 100, ""}, {2, 100, ""}, {3, 100, ""}, {4, 300, "firing"},
+		}},
+	}
+	start := time.Date(2022, 3, 3, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			rule, err := ParseRule(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := new(seriesState)
+			for _, step := range test.steps {
+				// bytes are 1 per packet, so bps is 8 * pps
+				stat := nffile.StatRecord{NumpacketsTcp: step.packets, NumbytesTcp: step.packets, NumpacketsUdp: 1000}
+				when := start.Add(time.Duration(step.minute) * time.Minute)
+				if status, _, _ := rule.evaluate(state, when, &stat); status != step.status {
+					t.Errorf("minute %d: status %q, want %q", step.minute, status, step.status)
+				}
+			}
+		})
+	}
+}
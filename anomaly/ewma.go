@@ -0,0 +1,234 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * anomaly detects volumetric anomalies e.g. DDoS attacks. For each channel,
+ * exporter and proto an exponentially weighted moving average (EWMA) and
+ * variance of pps and fps is maintained. A record, which exceeds the baseline
+ * by more than sigma standard deviations, is reported as anomaly. The baselines
+ * are saved into a state file, so detection continues after a restart.
+ */
+
+package anomaly
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"nfinflux/nffile"
+	"nfinflux/output"
+	"os"
+	"time"
+)
+
+// how often the baselines are saved into the state file
+const saveInterval = 5 * time.Minute
+
+type baselineKey struct {
+	channel  string
+	exporter string
+	proto    string
+	metric   string
+}
+
+// Baseline is the EWMA state of a series
+type Baseline struct {
+	Channel  string  `json:"channel"`
+	Exporter string  `json:"exporter"`
+	Proto    string  `json:"proto"`
+	Metric   string  `json:"metric"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Count    int     `json:"count"`
+}
+
+type EwmaConf struct {
+	alpha     float64
+	sigma     float64
+	warmup    int
+	stateFile string
+	lastSave  time.Time
+	baselines map[baselineKey]*Baseline
+	// anomalies are written to these outputs
+	writer output.AnomalyWriter
+}
+
+// New creates an EWMA anomaly detector, which reports anomalies to writer.
+// alpha is the EWMA smoothing factor, sigma the number of standard deviations
+// a record must exceed the baseline. Baselines are loaded from and saved into
+// stateFile, if not empty.
+func New(alpha float64, sigma float64, stateFile string, writer output.AnomalyWriter) (*EwmaConf, error) {
+	if alpha <= 0 || alpha >= 1 {
+		return nil, fmt.Errorf("anomaly: alpha must be between 0 and 1")
+	}
+	if sigma <= 0 {
+		return nil, fmt.Errorf("anomaly: sigma must be greater than 0")
+	}
+	ewmaConf := new(EwmaConf)
+	ewmaConf.alpha = alpha
+	ewmaConf.sigma = sigma
+	// a baseline is trusted after about 1/alpha records
+	ewmaConf.warmup = int(math.Ceil(1 / alpha))
+	ewmaConf.stateFile = stateFile
+	ewmaConf.writer = writer
+	ewmaConf.baselines = make(map[baselineKey]*Baseline)
+	if len(stateFile) > 0 {
+		if err := ewmaConf.load(); err != nil {
+			return nil, err
+		}
+	}
+	return ewmaConf, nil
+} // End of New
+
+// load the baselines from the state file. A missing file is not an error
+func (ewmaConf *EwmaConf) load() error {
+	data, err := os.ReadFile(ewmaConf.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("anomaly: %v", err)
+	}
+	var baselines []*Baseline
+	if err := json.Unmarshal(data, &baselines); err != nil {
+		return fmt.Errorf("anomaly: state file %s: %v", ewmaConf.stateFile, err)
+	}
+	for _, baseline := range baselines {
+		key := baselineKey{baseline.Channel, baseline.Exporter, baseline.Proto, baseline.Metric}
+		ewmaConf.baselines[key] = baseline
+	}
+	fmt.Printf("Loaded %d anomaly baselines from %s\n", len(baselines), ewmaConf.stateFile)
+	return nil
+}
+
+// save the baselines into the state file
+func (ewmaConf *EwmaConf) save() error {
+	if len(ewmaConf.stateFile) == 0 {
+		return nil
+	}
+	baselines := make([]*Baseline, 0, len(ewmaConf.baselines))
+	for _, baseline := range ewmaConf.baselines {
+		baselines = append(baselines, baseline)
+	}
+	data, err := json.Marshal(baselines)
+	if err != nil {
+		return err
+	}
+	// replace the state file atomically
+	tmpFile := ewmaConf.stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("anomaly: %v", err)
+	}
+	if err := os.Rename(tmpFile, ewmaConf.stateFile); err != nil {
+		return fmt.Errorf("anomaly: %v", err)
+	}
+	ewmaConf.lastSave = time.Now()
+	return nil
+}
+
+func (ewmaConf *EwmaConf) StartWrite() error {
+	return nil
+}
+
+func (ewmaConf *EwmaConf) InsertStat(when time.Time, channel string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	protoStats := [4]struct {
+		proto   string
+		packets uint64
+		flows   uint64
+	}{
+		{"tcp", statRecord.NumpacketsTcp, statRecord.NumflowsTcp},
+		{"udp", statRecord.NumpacketsUdp, statRecord.NumflowsUdp},
+		{"icmp", statRecord.NumpacketsIcmp, statRecord.NumflowsIcmp},
+		{"other", statRecord.NumpacketsOther, statRecord.NumflowsOther},
+	}
+	for _, stat := range protoStats {
+		ewmaConf.update(when, baselineKey{channel, exporterID, stat.proto, "pps"}, float64(stat.packets))
+		ewmaConf.update(when, baselineKey{channel, exporterID, stat.proto, "fps"}, float64(stat.flows))
+	}
+
+	if len(ewmaConf.stateFile) > 0 && time.Since(ewmaConf.lastSave) > saveInterval {
+		if err := ewmaConf.save(); err != nil {
+			fmt.Printf("Save anomaly baselines: %v\n", err)
+		}
+	}
+}
+
+// check value against the baseline of its series and update the baseline.
+// An anomaly is capped at sigma standard deviations above the baseline for the
+// update, so an attack raises the baseline slowly, while a lasting change of
+// the traffic level is still learned.
+func (ewmaConf *EwmaConf) update(when time.Time, key baselineKey, value float64) {
+	baseline, ok := ewmaConf.baselines[key]
+	if !ok {
+		ewmaConf.baselines[key] = &Baseline{
+			Channel:  key.channel,
+			Exporter: key.exporter,
+			Proto:    key.proto,
+			Metric:   key.metric,
+			Mean:     value,
+			Count:    1,
+		}
+		return
+	}
+
+	if baseline.Count >= ewmaConf.warmup {
+		// counting noise as lower bound avoids alarms on nearly constant series
+		stddev := math.Max(math.Sqrt(baseline.Variance), math.Sqrt(baseline.Mean))
+		if stddev > 0 {
+			severity := (value - baseline.Mean) / stddev
+			if severity > ewmaConf.sigma {
+				fmt.Printf("Anomaly for '%s', exporter: %s, %s %s: %.0f, baseline: %.0f, severity: %.1f\n",
+					key.channel, key.exporter, key.proto, key.metric, value, baseline.Mean, severity)
+				ewmaConf.writer.InsertAnomaly(when, key.channel, key.exporter, key.proto, key.metric, value, baseline.Mean, stddev, severity)
+				value = baseline.Mean + ewmaConf.sigma*stddev
+			}
+		}
+	}
+
+	diff := value - baseline.Mean
+	incr := ewmaConf.alpha * diff
+	baseline.Mean += incr
+	baseline.Variance = (1 - ewmaConf.alpha) * (baseline.Variance + diff*incr)
+	baseline.Count++
+} // End of update
+
+// Takeover continues the baselines of the replaced detector old on reload
+func (ewmaConf *EwmaConf) Takeover(old *EwmaConf) {
+	ewmaConf.baselines = old.baselines
+	ewmaConf.lastSave = old.lastSave
+}
+
+// EndWrite saves the baselines
+func (ewmaConf *EwmaConf) EndWrite() error {
+	return ewmaConf.save()
+}
+
+func (ewmaConf *EwmaConf) Close() error {
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package anomaly
+
+import (
+	"math"
+	"nfinflux/nffile"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testAnomalies records the severity of all anomaly points
+type testAnomalies struct {
+	severities []float64
+}
+
+func (writer *testAnomalies) InsertAnomaly(when time.Time, ident string, exporterID string, proto string, metric string, value float64, baseline float64, stddev float64, severity float64) {
+	writer.severities = append(writer.severities, severity)
+}
+
+// sequence of n equal values
+func repeat(value float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func TestEwmaUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		alpha  float64
+		values []float64
+		// indexes of the anomalous values
+		anomalies    []int
+		mean         float64
+		variance     float64
+		checkAverage bool
+	}{
+		{name: "warmup", alpha: 0.5, values: []float64{100, 10000},
+			mean: 5050, variance: 0.5 * 9900 * 4950, checkAverage: true},
+		{name: "constant", alpha: 0.5, values: repeat(100, 10),
+			mean: 100, checkAverage: true},
+		// the spike is capped at 100 + 3*sqrt(100) for the update
+		{name: "spike", alpha: 0.5, values: []float64{100, 100, 100, 10000},
+			anomalies: []int{3}, mean: 115, variance: 225, checkAverage: true},
+		{name: "drop", alpha: 0.5, values: []float64{100, 100, 100, 0},
+			mean: 50, variance: 2500, checkAverage: true},
+		// a lasting change of the level is learned
+		{name: "level shift", alpha: 0.1, values: append(repeat(100, 10), repeat(1000, 60)...),
+			anomalies: []int{10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(testAnomalies)
+			ewmaConf, err := New(test.alpha, 3, "", writer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := baselineKey{"live", "1", "tcp", "pps"}
+			var anomalies []int
+			for i, value := range test.values {
+				n := len(writer.severities)
+				ewmaConf.update(time.Now(), key, value)
+				if len(writer.severities) > n {
+					anomalies = append(anomalies, i)
+				}
+			}
+			if !reflect.DeepEqual(anomalies, test.anomalies) {
+				t.Errorf("anomalies at %v, want %v", anomalies, test.anomalies)
+			}
+			baseline := ewmaConf.baselines[key]
+			if baseline.Count != len(test.values) {
+				t.Errorf("count %d, want %d", baseline.Count, len(test.values))
+			}
+			if test.checkAverage && (math.Abs(baseline.Mean-test.mean) > 1e-9 || math.Abs(baseline.Variance-test.variance) > 1e-9) {
+				t.Errorf("mean %f variance %f, want %f %f", baseline.Mean, baseline.Variance, test.mean, test.variance)
+			}
+		})
+	}
+}
+
+func TestEwmaInvalid(t *testing.T) {
+	for _, params := range [][2]float64{{0, 3}, {1, 3}, {0.5, 0}} {
+		if _, err := New(params[0], params[1], "", nil); err == nil {
+			t.Errorf("New(%v, %v) accepted invalid parameters", params[0], params[1])
+		}
+	}
+}
+
+func TestEwmaState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "baselines.json")
+	writer := new(testAnomalies)
+	ewmaConf, err := New(0.5, 3, stateFile, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Now()
+	for i := 0; i < 3; i++ {
+		ewmaConf.InsertStat(when, "live", "1", 300, nffile.StatRecord{NumpacketsTcp: 100, NumflowsUdp: 10})
+	}
+	if err := ewmaConf.EndWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted detector continues with the saved baselines
+	restarted, err := New(0.5, 3, stateFile, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restarted.baselines, ewmaConf.baselines) {
+		t.Errorf("loaded baselines differ from saved baselines")
+	}
+	if len(restarted.baselines) != 8 {
+		t.Errorf("loaded %d baselines, want 8", len(restarted.baselines))
+	}
+	restarted.InsertStat(when, "live", "1", 300, nffile.StatRecord{NumpacketsTcp: 10000, NumflowsUdp: 10})
+	if len(writer.severities) != 1 {
+		t.Errorf("got %d anomalies after restart, want 1", len(writer.severities))
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * seasonal analyses imported flow files offline. All records are collected
+ * during the import. At the end of the import, a baseline is built for each
+ * channel, proto and metric per day of week and hour of day from the median
+ * and median absolute deviation (MAD) of all records in this time slot. Every
+ * record gets a deviation score, which is the distance to the median in robust
+ * standard deviations. Scores are written for each interval and the largest
+ * deviations are listed as possible incidents.
+ */
+
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"nfinflux/nffile"
+	"nfinflux/output"
+	"sort"
+	"time"
+)
+
+// min number of records in a time slot to score its records
+const minSlotSamples = 3
+
+// number of incidents listed at the end of the analysis
+const maxIncidents = 20
+
+// time slots: day of week and hour of day
+const numSlots = 7 * 24
+
+type seasonalKey struct {
+	channel string
+	proto   string
+	metric  string
+}
+
+type seasonalSample struct {
+	when  time.Time
+	value float64
+}
+
+type incident struct {
+	key      seasonalKey
+	sample   seasonalSample
+	baseline float64
+	score    float64
+}
+
+type SeasonalConf struct {
+	minScore float64
+	series   map[seasonalKey][]seasonalSample
+	// deviation scores are written to these outputs
+	writer output.DeviationWriter
+}
+
+// NewSeasonal creates a seasonal analyser, which writes the deviation scores to
+// writer. Records with an absolute score of at least minScore are listed as
+// incidents.
+func NewSeasonal(minScore float64, writer output.DeviationWriter) *SeasonalConf {
+	seasonalConf := new(SeasonalConf)
+	seasonalConf.minScore = minScore
+	seasonalConf.series = make(map[seasonalKey][]seasonalSample)
+	seasonalConf.writer = writer
+	return seasonalConf
+} // End of NewSeasonal
+
+func (seasonalConf *SeasonalConf) StartWrite() error {
+	return nil
+}
+
+func (seasonalConf *SeasonalConf) InsertStat(when time.Time, channel string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	protoStats := [4]struct {
+		proto                 string
+		flows, packets, bytes uint64
+	}{
+		{"tcp", statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp},
+		{"udp", statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp},
+		{"icmp", statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp},
+		{"other", statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther},
+	}
+	for _, stat := range protoStats {
+		seasonalConf.add(seasonalKey{channel, stat.proto, "fps"}, when, stat.flows)
+		seasonalConf.add(seasonalKey{channel, stat.proto, "pps"}, when, stat.packets)
+		seasonalConf.add(seasonalKey{channel, stat.proto, "bps"}, when, stat.bytes)
+	}
+}
+
+func (seasonalConf *SeasonalConf) add(key seasonalKey, when time.Time, value uint64) {
+	seasonalConf.series[key] = append(seasonalConf.series[key], seasonalSample{when, float64(value)})
+}
+
+// time slot of a record. Flow file times carry the local time of the collector
+func timeSlot(when time.Time) int {
+	return int(when.Weekday())*24 + when.Hour()
+}
+
+// median of values. values get sorted
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// analyse scores all records of a series against its seasonal baselines
+func (seasonalConf *SeasonalConf) analyse(key seasonalKey, samples []seasonalSample) []incident {
+	var slotValues [numSlots][]float64
+	for _, sample := range samples {
+		slot := timeSlot(sample.when)
+		slotValues[slot] = append(slotValues[slot], sample.value)
+	}
+
+	// median and scale of each slot. The MAD is scaled to the standard
+	// deviation of a normal distribution, counting noise is the lower bound
+	var slotMedian, slotScale [numSlots]float64
+	for slot, values := range slotValues {
+		if len(values) < minSlotSamples {
+			continue
+		}
+		slotMedian[slot] = median(values)
+		deviations := make([]float64, len(values))
+		for i, value := range values {
+			deviations[i] = math.Abs(value - slotMedian[slot])
+		}
+		slotScale[slot] = math.Max(1.4826*median(deviations), math.Max(math.Sqrt(slotMedian[slot]), 1))
+	}
+
+	var incidents []incident
+	for _, sample := range samples {
+		slot := timeSlot(sample.when)
+		if len(slotValues[slot]) < minSlotSamples {
+			continue
+		}
+		score := (sample.value - slotMedian[slot]) / slotScale[slot]
+		seasonalConf.writer.InsertDeviation(sample.when, key.channel, key.proto, key.metric, sample.value, slotMedian[slot], score)
+		if math.Abs(score) >= seasonalConf.minScore {
+			incidents = append(incidents, incident{key, sample, slotMedian[slot], score})
+		}
+	}
+	return incidents
+} // End of analyse
+
+// EndWrite analyses all collected records. It must be called before the
+// outputs of the deviation scores end writing.
+func (seasonalConf *SeasonalConf) EndWrite() error {
+	if len(seasonalConf.series) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Seasonal analysis of %d series\n", len(seasonalConf.series))
+	var incidents []incident
+	for key, samples := range seasonalConf.series {
+		incidents = append(incidents, seasonalConf.analyse(key, samples)...)
+	}
+	seasonalConf.series = make(map[seasonalKey][]seasonalSample)
+
+	sort.Slice(incidents, func(i, j int) bool {
+		return math.Abs(incidents[i].score) > math.Abs(incidents[j].score)
+	})
+	fmt.Printf("%d records deviate by at least %.1f\n", len(incidents), seasonalConf.minScore)
+	for i, incident := range incidents {
+		if i == maxIncidents {
+			break
+		}
+		fmt.Printf("%v '%s' %s %s: %.0f, baseline: %.0f, score: %.1f\n", incident.sample.when,
+			incident.key.channel, incident.key.proto, incident.key.metric, incident.sample.value, incident.baseline, incident.score)
+	}
+	return nil
+} // End of EndWrite
+
+func (seasonalConf *SeasonalConf) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package anomaly
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testDeviations records the scores of all deviation points
+type testDeviations struct {
+	scores []float64
+}
+
+func (writer *testDeviations) InsertDeviation(when time.Time, ident string, proto string, metric string, value float64, baseline float64, score float64) {
+	writer.scores = append(writer.scores, score)
+}
+
+func TestAnalyse(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		// expected score of each value, nil for not scored
+		scores []float64
+		// number of incidents with minScore 5
+		incidents int
+	}{
+		// MAD 0: the counting noise sqrt(100) is the scale
+		{"zero spread", []float64{100, 100, 100, 200}, []float64{0, 0, 0, 10}, 1},
+		// MAD 0 and median 0: the scale is at least 1
+		{"zero values", []float64{0, 0, 0, 3}, []float64{0, 0, 0, 3}, 0},
+		{"spread", []float64{90, 100, 110, 100, 300}, []float64{-10 / 14.826, 0, 10 / 14.826, 0, 200 / 14.826}, 1},
+		{"drop", []float64{1000, 1000, 1000, 1000, 0}, []float64{0, 0, 0, 0, -1000 / math.Sqrt(1000)}, 1},
+		{"too few samples", []float64{100, 200}, nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(testDeviations)
+			seasonalConf := NewSeasonal(5, writer)
+			// the same hour of the same weekday in consecutive weeks
+			start := time.Date(2022, 3, 3, 12, 0, 0, 0, time.UTC)
+			var samples []seasonalSample
+			for i, value := range test.values {
+				samples = append(samples, seasonalSample{start.AddDate(0, 0, 7*i), value})
+			}
+			incidents := seasonalConf.analyse(seasonalKey{"live", "tcp", "pps"}, samples)
+			if len(incidents) != test.incidents {
+				t.Errorf("got %d incidents, want %d", len(incidents), test.incidents)
+			}
+			if len(writer.scores) != len(test.scores) {
+				t.Fatalf("got %d scores, want %d", len(writer.scores), len(test.scores))
+			}
+			for i, score := range writer.scores {
+				if math.IsNaN(score) || math.Abs(score-test.scores[i]) > 1e-9 {
+					t.Errorf("value %.0f: score %f, want %f", test.values[i], score, test.scores[i])
+				}
+			}
+		})
+	}
+}
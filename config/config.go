@@ -0,0 +1,228 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * config reads the nfinflux configuration file. The file is YAML. All top
+ * level keys except inputs, outputs and routes are options with the name of
+ * the command line flags e.g.
+ *
+ *   host: http://127.0.0.1:8086
+ *   token: secret
+ *   inputs:
+ *     - listen: unix:///tmp/nfinflux.sock, tcp://0.0.0.0:9995
+ *     - watch: /var/flows/live
+ *     - import: /var/flows/archive
+ *       twin: 60
+ *   outputs:
+ *     - name: main
+ *       output: influx
+ *       bucket: life
+ *     - name: cust1
+ *       output: influx
+ *       bucket: cust1
+ *       token: other
+ *   routes:
+ *     - channel: cust1*
+ *       outputs: cust1
+ *     - channel: "*"
+ *       outputs: main
+ *
+ * An output entry takes the same options, which override the top level
+ * options for this output.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StringList is a YAML list of strings or a comma separated string
+type StringList []string
+
+func (list *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []string
+	if err := unmarshal(&values); err == nil {
+		*list = values
+		return nil
+	}
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*list = nil
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			*list = append(*list, entry)
+		}
+	}
+	return nil
+}
+
+// optionValue is the flag value of an option. Scalars keep their text, so
+// e.g. the octal socket-mode 0660 is not converted to the int 432.
+type optionValue string
+
+func (value *optionValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var decoded interface{}
+	if err := unmarshal(&decoded); err != nil {
+		return err
+	}
+	switch decoded := decoded.(type) {
+	case nil:
+		*value = ""
+	case bool:
+		// yes, on etc. are booleans in YAML
+		*value = optionValue(fmt.Sprint(decoded))
+	case []interface{}:
+		var list []optionValue
+		if err := unmarshal(&list); err != nil {
+			return err
+		}
+		entries := make([]string, 0, len(list))
+		for _, entry := range list {
+			entries = append(entries, string(entry))
+		}
+		*value = optionValue(strings.Join(entries, ","))
+	case map[interface{}]interface{}:
+		return fmt.Errorf("option value must be a scalar or a list")
+	default:
+		var text string
+		if err := unmarshal(&text); err != nil {
+			return err
+		}
+		*value = optionValue(text)
+	}
+	return nil
+}
+
+// Input is either a list of listen addresses, watched directories or directories
+// to import once. twin is the time interval of the flow files, 0 for default.
+type Input struct {
+	Listen StringList `yaml:"listen"`
+	Watch  StringList `yaml:"watch"`
+	Import StringList `yaml:"import"`
+	Twin   int        `yaml:"twin"`
+}
+
+// Output is a named output of type output with its own options
+type Output struct {
+	Name    string
+	Type    string
+	Options map[string]string
+}
+
+// Route sends the records of all channels matching the pattern to the named outputs
+type Route struct {
+	Channel string     `yaml:"channel"`
+	Outputs StringList `yaml:"outputs"`
+}
+
+// Config is the content of a configuration file
+type Config struct {
+	Options map[string]string
+	Inputs  []Input
+	Outputs []Output
+	Routes  []Route
+}
+
+type fileConfig struct {
+	Inputs  []Input                  `yaml:"inputs"`
+	Outputs []map[string]optionValue `yaml:"outputs"`
+	Routes  []Route                  `yaml:"routes"`
+	Options map[string]optionValue   `yaml:",inline"`
+}
+
+// Load reads and verifies the configuration file
+func Load(fileName string) (*Config, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file fileConfig
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	config := &Config{Inputs: file.Inputs, Routes: file.Routes}
+	config.Options = optionValues(file.Options)
+	for i, input := range config.Inputs {
+		n := 0
+		for _, list := range []StringList{input.Listen, input.Watch, input.Import} {
+			if len(list) > 0 {
+				n++
+			}
+		}
+		if n != 1 {
+			return nil, fmt.Errorf("%s: input %d requires one of listen, watch or import", fileName, i+1)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, entry := range file.Outputs {
+		options := optionValues(entry)
+		output := Output{Name: options["name"], Type: options["output"], Options: options}
+		delete(options, "name")
+		delete(options, "output")
+		if len(output.Type) == 0 {
+			output.Type = output.Name
+		}
+		if len(output.Name) == 0 {
+			output.Name = output.Type
+		}
+		if len(output.Name) == 0 {
+			return nil, fmt.Errorf("%s: output %d requires a name or output type", fileName, i+1)
+		}
+		if names[output.Name] {
+			return nil, fmt.Errorf("%s: duplicate output name: %s", fileName, output.Name)
+		}
+		names[output.Name] = true
+		config.Outputs = append(config.Outputs, output)
+	}
+
+	for i, route := range config.Routes {
+		if len(route.Channel) == 0 || len(route.Outputs) == 0 {
+			return nil, fmt.Errorf("%s: route %d requires a channel and outputs", fileName, i+1)
+		}
+	}
+	return config, nil
+} // End of Load
+
+// convert the YAML values of the options to the string values of flags
+func optionValues(options map[string]optionValue) map[string]string {
+	values := make(map[string]string)
+	for key, value := range options {
+		values[key] = string(value)
+	}
+	return values
+}
@@ -0,0 +1,148 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// write content into a config file of the test
+func writeConfig(t *testing.T, content string) string {
+	fileName := filepath.Join(t.TempDir(), "nfinflux.yaml")
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestOptionValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"octal mode", "socket-mode: 0660\n", map[string]string{"socket-mode": "0660"}, false},
+		{"quoted mode", "socket-mode: \"0660\"\n", map[string]string{"socket-mode": "0660"}, false},
+		{"int", "twin: 300\n", map[string]string{"twin": "300"}, false},
+		{"float", "anomaly-sigma: 3.5\n", map[string]string{"anomaly-sigma": "3.5"}, false},
+		{"bool", "create: yes\n", map[string]string{"create": "true"}, false},
+		{"duration", "stats-interval: 1m\n", map[string]string{"stats-interval": "1m"}, false},
+		{"empty", "token:\n", map[string]string{"token": ""}, false},
+		{"list", "allow-uid: [0, 0100]\n", map[string]string{"allow-uid": "0,0100"}, false},
+		{"map", "tags:\n  site: fra1\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := Load(writeConfig(t, test.content))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Load accepted %q", test.content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.Options, test.want) {
+				t.Errorf("options %v, want %v", config.Options, test.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	config, err := Load(writeConfig(t, `
+host: http://127.0.0.1:8086
+inputs:
+  - listen: unix:///tmp/nfinflux.sock, tcp://0.0.0.0:9995
+  - import: /var/flows/archive
+    twin: 60
+outputs:
+  - name: cust1
+    output: influx
+    bucket: cust1
+  - output: graphite
+    graphite-prefix: 0100
+routes:
+  - channel: cust1*
+    outputs: cust1
+  - channel: "*"
+    outputs: [cust1, graphite]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantInputs := []Input{
+		{Listen: StringList{"unix:///tmp/nfinflux.sock", "tcp://0.0.0.0:9995"}},
+		{Import: StringList{"/var/flows/archive"}, Twin: 60},
+	}
+	if !reflect.DeepEqual(config.Inputs, wantInputs) {
+		t.Errorf("inputs %+v, want %+v", config.Inputs, wantInputs)
+	}
+	wantOutputs := []Output{
+		{Name: "cust1", Type: "influx", Options: map[string]string{"bucket": "cust1"}},
+		{Name: "graphite", Type: "graphite", Options: map[string]string{"graphite-prefix": "0100"}},
+	}
+	if !reflect.DeepEqual(config.Outputs, wantOutputs) {
+		t.Errorf("outputs %+v, want %+v", config.Outputs, wantOutputs)
+	}
+	wantRoutes := []Route{
+		{Channel: "cust1*", Outputs: StringList{"cust1"}},
+		{Channel: "*", Outputs: StringList{"cust1", "graphite"}},
+	}
+	if !reflect.DeepEqual(config.Routes, wantRoutes) {
+		t.Errorf("routes %+v, want %+v", config.Routes, wantRoutes)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"two input types", "inputs:\n  - listen: tcp://0.0.0.0:9995\n    watch: /var/flows\n"},
+		{"no input type", "inputs:\n  - twin: 60\n"},
+		{"duplicate output", "outputs:\n  - output: influx\n  - name: influx\n"},
+		{"unnamed output", "outputs:\n  - bucket: cust1\n"},
+		{"route without outputs", "routes:\n  - channel: cust1*\n"},
+		{"unknown input key", "inputs:\n  - listen: tcp://0.0.0.0:9995\n    port: 9995\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Load(writeConfig(t, test.content)); err == nil {
+				t.Errorf("Load accepted %q", test.content)
+			}
+		})
+	}
+}
@@ -35,13 +35,18 @@ package main
 
 import (
 	"fmt"
-	"nfinflux/influx"
+	"nfinflux/metrics"
 	"nfinflux/nffile"
+	"nfinflux/output"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// time between two scans of the watched directories
+const watchInterval = 10 * time.Second
+
 type flowFile struct {
 	fileName string
 	timeSlot time.Time
@@ -63,6 +68,10 @@ func enumerateFiles(pathList []string) chan flowFile {
 				if info.Mode().IsRegular() {
 					var timeString string
 					fileName := info.Name()
+					// skip files of nfcapd, still collecting flows
+					if strings.HasPrefix(fileName, "nfcapd.current.") {
+						return nil
+					}
 					// check if it's a know nfcapd.xx file name
 					if n, _ := fmt.Sscanf(fileName, "nfcapd.%s", &timeString); n != 0 {
 						var t time.Time
@@ -84,49 +93,90 @@ func enumerateFiles(pathList []string) chan flowFile {
 	return fileChannel
 } // End of enumerateFiles
 
-// create the rate e.g. values/s for fps, pps and bps
-func calculateRate(stat *nffile.StatRecord, rate uint64) {
-	stat.Numflows /= rate
-	stat.Numbytes /= rate
-	stat.Numpackets /= rate
-	// flow stat /= rate
-	stat.NumflowsTcp /= rate
-	stat.NumflowsUdp /= rate
-	stat.NumflowsIcmp /= rate
-	stat.NumflowsOther /= rate
-	// bytes stat
-	stat.NumbytesTcp /= rate
-	stat.NumbytesUdp /= rate
-	stat.NumbytesIcmp /= rate
-	stat.NumbytesOther /= rate
-	// packet stat
-	stat.NumpacketsTcp /= rate
-	stat.NumpacketsUdp /= rate
-	stat.NumpacketsIcmp /= rate
-	stat.NumpacketsOther /= rate
+// import a flow file and write its stat record
+func importFile(nfFile *nffile.NfFile, file flowFile, twin int, writer output.Writer) error {
+	if err := nfFile.Open(file.fileName); err != nil {
+		nfFile.Close()
+		return err
+	}
+	stat := nfFile.Stat()
+	nffile.CalculateRate(&stat, uint64(twin))
+	writer.InsertStat(file.timeSlot, nfFile.Ident(), "0", twin, stat)
+	metrics.Files.Add(1)
+	return nfFile.Close()
 }
 
-func setupFileFeeder(scanDirs []string, bucket string, twin int, influxDB *influx.InfluxDBConf) {
+func setupFileFeeder(scanDirs []string, twin int, writer output.Writer) {
 	fileChannel := enumerateFiles((scanDirs))
 
 	nfFile := nffile.New()
-	influxDB.StartWrite(bucket)
-	exporterID := "0"
+	if err := writer.StartWrite(); err != nil {
+		fmt.Printf("Start write: %v\n", err)
+	}
 	fileCnt := 0
 	for file := range fileChannel {
 		fmt.Printf("file path: %s Time: %v\r", file.fileName, file.timeSlot)
-		if err := nfFile.Open(file.fileName); err != nil {
+		if err := importFile(nfFile, file, twin, writer); err != nil {
 			panic(err)
 		}
-		// nfFile.String()
-		stat := nfFile.Stat()
-		calculateRate(&stat, uint64(twin))
-		influxDB.InsertStat(file.timeSlot, nfFile.Ident(), exporterID, stat)
-		nfFile.Close()
 		fileCnt++
 	}
 	fmt.Printf("\nInsert stat, processed %d files\n", fileCnt)
-	if err := influxDB.EndWrite(); err != nil {
+	if err := writer.EndWrite(); err != nil {
 		fmt.Printf("Insert stat record(s): %v\n", err)
 	}
 }
+
+// find the flow files of a watched directory newer than lastSlot
+func newFiles(watchDir string, lastSlot time.Time) []flowFile {
+	var files []flowFile
+	for file := range enumerateFiles([]string{watchDir}) {
+		if file.timeSlot.After(lastSlot) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// scan the watched directories every watchInterval and import all new flow
+// files until done gets closed. The files present at startup are skipped.
+func setupDirWatcher(watchDirs []string, twin int, writer output.Writer, done chan bool) {
+	lastSlot := make(map[string]time.Time)
+	for _, watchDir := range watchDirs {
+		for _, file := range newFiles(watchDir, time.Time{}) {
+			if file.timeSlot.After(lastSlot[watchDir]) {
+				lastSlot[watchDir] = file.timeSlot
+			}
+		}
+		fmt.Printf("nfinflux watching %s for new flow files\n", watchDir)
+	}
+
+	nfFile := nffile.New()
+	if err := writer.StartWrite(); err != nil {
+		fmt.Printf("Start write: %v\n", err)
+	}
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if err := writer.EndWrite(); err != nil {
+				fmt.Printf("Insert stat record(s): %v\n", err)
+			}
+			return
+		case <-ticker.C:
+			for _, watchDir := range watchDirs {
+				for _, file := range newFiles(watchDir, lastSlot[watchDir]) {
+					if err := importFile(nfFile, file, twin, writer); err != nil {
+						fmt.Printf("Import %s: %v\n", file.fileName, err)
+						continue
+					}
+					fmt.Printf("Insert stat of %s\n", file.fileName)
+					if file.timeSlot.After(lastSlot[watchDir]) {
+						lastSlot[watchDir] = file.timeSlot
+					}
+				}
+			}
+		}
+	}
+} // End of setupDirWatcher
@@ -0,0 +1,174 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * graphite writes the stat records as Graphite plaintext lines
+ *   prefix.channel.exporter.proto.flows value timestamp
+ * to a Carbon server over TCP or UDP
+ */
+
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"strings"
+	"time"
+)
+
+type GraphiteConf struct {
+	network  string
+	address  string
+	prefix   string
+	replace  string
+	conn     net.Conn
+	errList  []error
+	lastDial time.Time
+}
+
+// New creates a Graphite output for address host:port. network is "tcp" or "udp".
+// Any character of an ident, not valid in a Graphite path, is replaced by replace.
+func New(network string, address string, prefix string, replace string) (*GraphiteConf, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("graphite: unsupported network: %s", network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("graphite: %v", err)
+	}
+
+	graphite := new(GraphiteConf)
+	graphite.network = network
+	graphite.address = address
+	graphite.prefix = strings.Trim(prefix, ".")
+	graphite.replace = replace
+	return graphite, nil
+} // End of New
+
+// sanitize converts an ident or exporter into a single Graphite path node
+func (graphite *GraphiteConf) sanitize(name string) string {
+	var sb strings.Builder
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			sb.WriteRune(c)
+		default:
+			sb.WriteString(graphite.replace)
+		}
+	}
+	if sb.Len() == 0 {
+		return "unknown"
+	}
+	return sb.String()
+}
+
+func (graphite *GraphiteConf) connect() error {
+	graphite.lastDial = time.Now()
+	conn, err := net.DialTimeout(graphite.network, graphite.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	graphite.conn = conn
+	return nil
+}
+
+func (graphite *GraphiteConf) StartWrite() error {
+	return graphite.connect()
+}
+
+func (graphite *GraphiteConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	path := graphite.sanitize(ident) + "." + graphite.sanitize(exporterID)
+	if len(graphite.prefix) > 0 {
+		path = graphite.prefix + "." + path
+	}
+	ts := when.Unix()
+
+	var buf bytes.Buffer
+	writeProto := func(proto string, flows, packets, octets uint64) {
+		fmt.Fprintf(&buf, "%s.%s.flows %d %d\n", path, proto, flows, ts)
+		fmt.Fprintf(&buf, "%s.%s.packets %d %d\n", path, proto, packets, ts)
+		fmt.Fprintf(&buf, "%s.%s.bytes %d %d\n", path, proto, octets, ts)
+	}
+	writeProto("tcp", statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp)
+	writeProto("udp", statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp)
+	writeProto("icmp", statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp)
+	writeProto("other", statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther)
+	writeProto("total", statRecord.Numflows, statRecord.Numpackets, statRecord.Numbytes)
+	fmt.Fprintf(&buf, "%s.total.sequence_failures %d %d\n", path, statRecord.SequenceFailure, ts)
+	if interval > 0 {
+		fmt.Fprintf(&buf, "%s.interval %d %d\n", path, interval, ts)
+	}
+
+	numLines := int64(bytes.Count(buf.Bytes(), []byte("\n")))
+
+	if graphite.conn == nil {
+		// reconnect, but do not hammer a dead server
+		if time.Since(graphite.lastDial) < 10*time.Second {
+			graphite.errList = append(graphite.errList, fmt.Errorf("graphite: not connected"))
+			metrics.PointsFailed.Add(numLines)
+			return
+		}
+		if err := graphite.connect(); err != nil {
+			graphite.errList = append(graphite.errList, err)
+			fmt.Printf("graphite connect error: %v\n", err)
+			metrics.PointsFailed.Add(numLines)
+			return
+		}
+	}
+
+	// one datagram per stat record in case of udp
+	if _, err := graphite.conn.Write(buf.Bytes()); err != nil {
+		graphite.errList = append(graphite.errList, err)
+		fmt.Printf("graphite write error: %v\n", err)
+		metrics.WriteErrors.Add(1)
+		metrics.PointsFailed.Add(numLines)
+		graphite.conn.Close()
+		graphite.conn = nil
+		return
+	}
+	metrics.PointsWritten.Add(numLines)
+}
+
+func (graphite *GraphiteConf) EndWrite() error {
+	if graphite.errList != nil {
+		return fmt.Errorf("graphite failed writes: %d", len(graphite.errList))
+	}
+	return nil
+}
+
+func (graphite *GraphiteConf) Close() error {
+	if graphite.conn != nil {
+		err := graphite.conn.Close()
+		graphite.conn = nil
+		return err
+	}
+	return nil
+}
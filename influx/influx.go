@@ -30,35 +30,62 @@
 package influx
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"nfinflux/metrics"
 	"nfinflux/nffile"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
-	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/influxdata/influxdb-client-go/v2/domain"
 )
 
+type protoStat struct {
+	proto   string
+	flows   uint64
+	packets uint64
+	bytes   uint64
+}
+
 type InfluxDBConf struct {
 	host     string
 	token    string
 	org      string
+	bucket   string
 	client   influxdb2.Client
 	writeAPI api.WriteAPI
+	errLock  sync.Mutex
 	errList  []error
 	dOrg     *domain.Organization
+	// InfluxDB 1.x compatibility
+	v1       bool
+	user     string
+	password string
+	// add derived fields
+	derived bool
+	schema  Schema
 }
 
-func New(host string, org string, token string, verifyOrg bool) (*InfluxDBConf, error) {
+func New(host string, org string, token string, bucket string, verifyOrg bool) (*InfluxDBConf, error) {
 	influxDB := new(InfluxDBConf)
 	influxDB.host = host
 	influxDB.token = token
 	influxDB.org = org
+	influxDB.bucket = bucket
+	influxDB.schema = DefaultSchema()
 
-	client := influxdb2.NewClientWithOptions(host, token,
-		influxdb2.DefaultOptions().SetPrecision(time.Millisecond))
+	options := influxdb2.DefaultOptions().SetPrecision(time.Millisecond)
+	// the non-blocking write API does not report written points
+	httpClient := options.HTTPClient()
+	httpClient.Transport = &pointCounter{httpClient.Transport}
+	client := influxdb2.NewClientWithOptions(host, token, options)
 
 	influxDB.client = client
 
@@ -73,6 +100,60 @@ func New(host string, org string, token string, verifyOrg bool) (*InfluxDBConf,
 	return influxDB, nil
 } // End of NewExporter
 
+// pointCounter counts the line protocol points of write requests as written
+// or failed. Points of a retried batch count again.
+type pointCounter struct {
+	transport http.RoundTripper
+}
+
+func (counter *pointCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/write") || req.Body == nil {
+		return counter.transport.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	numPoints := int64(bytes.Count(body, []byte("\n")))
+
+	resp, err := counter.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode/100 != 2 {
+		metrics.PointsFailed.Add(numPoints)
+	} else {
+		metrics.PointsWritten.Add(numPoints)
+	}
+	return resp, err
+}
+
+// SetDerived enables the derived fields average packet size, average flow size
+// and the share of the proto of all traffic
+func (influxDB *InfluxDBConf) SetDerived(derived bool) {
+	influxDB.derived = derived
+}
+
+// add the derived fields of a proto with prefix. Fields with a zero divisor are omitted
+func addDerived(fields map[string]interface{}, prefix string, stat protoStat, total protoStat) {
+	if stat.packets > 0 {
+		fields[prefix+"avg_packet_size"] = float64(stat.bytes) / float64(stat.packets)
+	}
+	if stat.flows > 0 {
+		fields[prefix+"avg_flow_bytes"] = float64(stat.bytes) / float64(stat.flows)
+		fields[prefix+"avg_flow_packets"] = float64(stat.packets) / float64(stat.flows)
+	}
+	if total.flows > 0 {
+		fields[prefix+"flows_pct"] = 100 * float64(stat.flows) / float64(total.flows)
+	}
+	if total.packets > 0 {
+		fields[prefix+"packets_pct"] = 100 * float64(stat.packets) / float64(total.packets)
+	}
+	if total.bytes > 0 {
+		fields[prefix+"bytes_pct"] = 100 * float64(stat.bytes) / float64(total.bytes)
+	}
+}
+
 func (influxDB *InfluxDBConf) Close() error {
 	if influxDB.client != nil {
 		influxDB.client.Close()
@@ -80,7 +161,12 @@ func (influxDB *InfluxDBConf) Close() error {
 	return nil
 }
 
-func (influxDB *InfluxDBConf) VerifyBucket(bucket string, createMissing bool, deleteExisting bool) (*domain.Bucket, error) {
+func (influxDB *InfluxDBConf) VerifyBucket(createMissing bool, deleteExisting bool) (*domain.Bucket, error) {
+	if influxDB.v1 {
+		return nil, influxDB.verifyDatabaseV1(createMissing, deleteExisting)
+	}
+
+	bucket := influxDB.bucket
 	bucketsAPI := influxDB.client.BucketsAPI()
 
 	var dBucket *domain.Bucket
@@ -125,19 +211,34 @@ func (influxDB *InfluxDBConf) VerifyBucket(bucket string, createMissing bool, de
 	return dBucket, err
 }
 
-func (influxDB *InfluxDBConf) StartWrite(bucket string) {
+func (influxDB *InfluxDBConf) StartWrite() error {
 	// get non-blocking write client
-	writeAPI := influxDB.client.WriteAPI(influxDB.org, bucket)
-	// Get errors channel
-	errorsCh := writeAPI.Errors()
-	// Create go proc for reading and logging errors
-	go func() {
-		for err := range errorsCh {
-			influxDB.errList = append(influxDB.errList, err)
-			fmt.Printf("write error: %s\n", err.Error())
-		}
-	}()
+	var writeAPI api.WriteAPI
+	if influxDB.v1 {
+		// the v1 write API reports errors of a flush, before it returns
+		writeAPI = newWriteAPIV1(influxDB)
+	} else {
+		writeAPI = influxDB.client.WriteAPI(influxDB.org, influxDB.bucket)
+		// Get errors channel
+		errorsCh := writeAPI.Errors()
+		// Create go proc for reading and logging errors
+		go func() {
+			for err := range errorsCh {
+				influxDB.writeError(err)
+			}
+		}()
+	}
 	influxDB.writeAPI = writeAPI
+	return nil
+}
+
+// log and count a failed write
+func (influxDB *InfluxDBConf) writeError(err error) {
+	influxDB.errLock.Lock()
+	influxDB.errList = append(influxDB.errList, err)
+	influxDB.errLock.Unlock()
+	fmt.Printf("write error %s: %s\n", influxDB, err.Error())
+	metrics.WriteErrors.Add(1)
 }
 
 func (influxDB *InfluxDBConf) Flush() {
@@ -146,83 +247,221 @@ func (influxDB *InfluxDBConf) Flush() {
 }
 
 func (influxDB *InfluxDBConf) EndWrite() error {
+	if influxDB.writeAPI == nil {
+		return nil
+	}
 	// Flush writes
-	influxDB.writeAPI.Flush()
+	if writeAPI, ok := influxDB.writeAPI.(*writeAPIV1); ok {
+		writeAPI.Close()
+	} else {
+		influxDB.writeAPI.Flush()
+	}
 	influxDB.writeAPI = nil
-	numErrors := 0
-	if influxDB.errList != nil {
-		numErrors = len(influxDB.errList)
-		return fmt.Errorf("failed writes: %d", numErrors)
+	influxDB.errLock.Lock()
+	defer influxDB.errLock.Unlock()
+	if numErrors := len(influxDB.errList); numErrors > 0 {
+		return fmt.Errorf("%s failed writes: %d", influxDB, numErrors)
 	}
 	return nil
 }
 
-func (influxDB *InfluxDBConf) InsertStat(when time.Time, ident string, exporterID string, statRecord nffile.StatRecord) {
+// String identifies the target bucket of the output in messages
+func (influxDB *InfluxDBConf) String() string {
+	return fmt.Sprintf("bucket '%s' at %s", influxDB.bucket, influxDB.host)
+}
+
+func (influxDB *InfluxDBConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
 	if influxDB.writeAPI == nil {
 		return
 	}
 
 	writeAPI := influxDB.writeAPI
 
-	// create point proto tcp
-	p := write.NewPoint(
-		"stat",
+	protoStats := [4]protoStat{
+		{"tcp", statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp},
+		{"udp", statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp},
+		{"icmp", statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp},
+		{"other", statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther},
+	}
+	var total protoStat
+	for _, stat := range protoStats {
+		total.flows += stat.flows
+		total.packets += stat.packets
+		total.bytes += stat.bytes
+	}
+
+	layout := influxDB.schema.Layout
+
+	// overall counters and sequence failures of the exporters
+	totalStat := protoStat{"total", statRecord.Numflows, statRecord.Numpackets, statRecord.Numbytes}
+	addTotal := func(fields map[string]interface{}, prefix string) {
+		fields[prefix+influxDB.fieldName("flows")] = totalStat.flows
+		fields[prefix+influxDB.fieldName("packets")] = totalStat.packets
+		fields[prefix+influxDB.fieldName("bytes")] = totalStat.bytes
+		fields["sequence_failures"] = statRecord.SequenceFailure
+		if statRecord.FirstSeen > 0 {
+			fields["first_seen"] = statRecord.FirstSeen
+			fields["last_seen"] = statRecord.LastSeen
+		}
+	}
+
+	// one point per proto and a total point
+	if layout == LayoutProto || layout == LayoutBoth {
+		for _, stat := range protoStats {
+			fields := map[string]interface{}{
+				influxDB.fieldName("flows"):   stat.flows,
+				influxDB.fieldName("packets"): stat.packets,
+				influxDB.fieldName("bytes"):   stat.bytes,
+			}
+			if interval > 0 {
+				fields["interval"] = interval
+			}
+			if influxDB.derived {
+				addDerived(fields, "", stat, total)
+			}
+			p := influxDB.newPoint(
+				influxDB.schema.Measurement,
+				map[string]string{
+					"channel": ident,
+					// "exporter": exporterID,
+					"proto": stat.proto,
+				},
+				fields,
+				when)
+			writeAPI.WritePoint(p)
+		}
+
+		fields := make(map[string]interface{})
+		addTotal(fields, "")
+		if interval > 0 {
+			fields["interval"] = interval
+		}
+		p := influxDB.newPoint(
+			influxDB.schema.Measurement,
+			map[string]string{
+				"channel": ident,
+				"proto":   totalStat.proto,
+			},
+			fields,
+			when)
+		writeAPI.WritePoint(p)
+	}
+
+	// one point for all protos
+	if layout == LayoutWide || layout == LayoutBoth {
+		fields := make(map[string]interface{})
+		for _, stat := range protoStats {
+			prefix := stat.proto + "_"
+			fields[prefix+influxDB.fieldName("flows")] = stat.flows
+			fields[prefix+influxDB.fieldName("packets")] = stat.packets
+			fields[prefix+influxDB.fieldName("bytes")] = stat.bytes
+			if influxDB.derived {
+				addDerived(fields, prefix, stat, total)
+			}
+		}
+		addTotal(fields, totalStat.proto+"_")
+		if interval > 0 {
+			fields["interval"] = interval
+		}
+		p := influxDB.newPoint(
+			influxDB.schema.WideMeasurement,
+			map[string]string{
+				"channel": ident,
+			},
+			fields,
+			when)
+		writeAPI.WritePoint(p)
+	}
+
+}
+
+// InsertStatus writes a collector_status point for a channel and exporter
+func (influxDB *InfluxDBConf) InsertStatus(when time.Time, ident string, exporterID string, up bool, missed int) {
+	if influxDB.writeAPI == nil {
+		return
+	}
+
+	p := influxDB.newPoint(
+		"collector_status",
 		map[string]string{
-			"channel": ident,
-			// "exporter": exporterID,
-			"proto": "tcp",
+			"channel":  ident,
+			"exporter": exporterID,
 		},
 		map[string]interface{}{
-			"flows":   statRecord.NumflowsTcp,
-			"packets": statRecord.NumpacketsTcp,
-			"bytes":   statRecord.NumbytesTcp,
+			"up":     up,
+			"missed": missed,
 		},
 		when)
-	writeAPI.WritePoint(p)
+	influxDB.writeAPI.WritePoint(p)
+}
 
-	p = write.NewPoint(
-		"stat",
+// InsertAnomaly writes an anomaly point for a channel, exporter and proto
+func (influxDB *InfluxDBConf) InsertAnomaly(when time.Time, ident string, exporterID string, proto string, metric string, value float64, baseline float64, stddev float64, severity float64) {
+	if influxDB.writeAPI == nil {
+		return
+	}
+
+	p := influxDB.newPoint(
+		"anomaly",
 		map[string]string{
-			"channel": ident,
-			// "exporter": exporterID,
-			"proto": "udp",
+			"channel":  ident,
+			"exporter": exporterID,
+			"proto":    proto,
+			"metric":   metric,
 		},
 		map[string]interface{}{
-			"flows":   statRecord.NumflowsUdp,
-			"packets": statRecord.NumpacketsUdp,
-			"bytes":   statRecord.NumbytesUdp,
+			"value":    value,
+			"baseline": baseline,
+			"stddev":   stddev,
+			"severity": severity,
 		},
 		when)
-	writeAPI.WritePoint(p)
+	influxDB.writeAPI.WritePoint(p)
+}
 
-	p = write.NewPoint(
-		"stat",
+// InsertDeviation writes a deviation point for a channel and proto
+func (influxDB *InfluxDBConf) InsertDeviation(when time.Time, ident string, proto string, metric string, value float64, baseline float64, score float64) {
+	if influxDB.writeAPI == nil {
+		return
+	}
+
+	p := influxDB.newPoint(
+		"deviation",
 		map[string]string{
 			"channel": ident,
-			//		"exporter": exporterID,
-			"proto": "icmp",
+			"proto":   proto,
+			"metric":  metric,
 		},
 		map[string]interface{}{
-			"flows":   statRecord.NumflowsIcmp,
-			"packets": statRecord.NumpacketsIcmp,
-			"bytes":   statRecord.NumbytesIcmp,
+			"value":    value,
+			"baseline": baseline,
+			"score":    score,
 		},
 		when)
-	writeAPI.WritePoint(p)
+	influxDB.writeAPI.WritePoint(p)
+}
 
-	p = write.NewPoint(
-		"stat",
+// InsertInternal writes a nfinflux_internal point with the internal counters,
+// tagged with the host name of the nfinflux instance
+func (influxDB *InfluxDBConf) InsertInternal(when time.Time, counters map[string]int64) {
+	if influxDB.writeAPI == nil {
+		return
+	}
+
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "unknown"
+	}
+	fields := make(map[string]interface{}, len(counters))
+	for name, value := range counters {
+		fields[name] = value
+	}
+	p := influxDB.newPoint(
+		"nfinflux_internal",
 		map[string]string{
-			"channel": ident,
-			// "exporter": exporterID,
-			"proto": "other",
-		},
-		map[string]interface{}{
-			"flows":   statRecord.NumflowsOther,
-			"packets": statRecord.NumpacketsOther,
-			"bytes":   statRecord.NumbytesOther,
+			"host": hostName,
 		},
+		fields,
 		when)
-	writeAPI.WritePoint(p)
-
+	influxDB.writeAPI.WritePoint(p)
 }
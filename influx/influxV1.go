@@ -0,0 +1,297 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * InfluxDB 1.x compatible write path. Points are sent as line protocol
+ * to the v1 /write?db=&rp= endpoint with username/password. This also works
+ * for VictoriaMetrics and other TSDBs, which accept the InfluxDB v1 protocol.
+ */
+
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"nfinflux/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// max number of lines buffered, before sent to the DB
+const v1BatchSize = 5000
+
+// max time lines are buffered, as with the async v2 write API
+const v1FlushInterval = time.Second
+
+// time to wait for the DB to accept a request
+const v1Timeout = 10 * time.Second
+
+// http client of all v1 requests
+var v1Client = &http.Client{Timeout: v1Timeout}
+
+type writeAPIV1 struct {
+	host            string
+	database        string
+	retentionPolicy string
+	user            string
+	password        string
+	// buffered lines
+	lock     sync.Mutex
+	lines    strings.Builder
+	numLines int
+	// serializes the requests of the flush ticker and full batches
+	sendLock sync.Mutex
+	onError  func(error)
+	done     chan bool
+	wg       sync.WaitGroup
+}
+
+// NewV1 creates an InfluxDB 1.x compatible connection. There are no orgs and
+// buckets in 1.x. The bucket name is 'database/retention-policy' or just
+// 'database' for the default policy.
+func NewV1(host string, user string, password string, bucket string) (*InfluxDBConf, error) {
+	if _, err := url.Parse(host); err != nil {
+		return nil, err
+	}
+	influxDB := new(InfluxDBConf)
+	influxDB.host = strings.TrimSuffix(host, "/")
+	influxDB.user = user
+	influxDB.password = password
+	influxDB.bucket = bucket
+	influxDB.schema = DefaultSchema()
+	influxDB.v1 = true
+	return influxDB, nil
+} // End of NewV1
+
+// split 'database/retention-policy' into its components
+func splitBucketV1(bucket string) (string, string) {
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		return bucket[:i], bucket[i+1:]
+	}
+	return bucket, ""
+}
+
+// execute an InfluxQL statement on the /query endpoint
+func (influxDB *InfluxDBConf) queryV1(query string) error {
+	form := url.Values{}
+	form.Set("q", query)
+	req, err := http.NewRequest("POST", influxDB.host+"/query", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(influxDB.user) > 0 {
+		req.SetBasicAuth(influxDB.user, influxDB.password)
+	}
+
+	resp, err := v1Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("query '%s' failed: %s: %s", query, resp.Status, strings.TrimSpace(string(body)))
+	}
+	// InfluxQL reports statement errors with status 200 in the result body
+	if bytes.Contains(body, []byte(`"error"`)) {
+		return fmt.Errorf("query '%s' failed: %s", query, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// v1 equivalent of VerifyBucket. Without create/delete request, nothing is verified
+// as not all v1 compatible TSDBs implement the /query endpoint.
+func (influxDB *InfluxDBConf) verifyDatabaseV1(createMissing bool, deleteExisting bool) error {
+	database, retentionPolicy := splitBucketV1(influxDB.bucket)
+	if len(database) == 0 {
+		return fmt.Errorf("missing database name")
+	}
+
+	if deleteExisting {
+		if err := influxDB.queryV1(fmt.Sprintf("DROP DATABASE %q", database)); err != nil {
+			return err
+		}
+		createMissing = true
+	}
+
+	if createMissing {
+		// CREATE is a no-op, if the database already exists
+		if err := influxDB.queryV1(fmt.Sprintf("CREATE DATABASE %q", database)); err != nil {
+			return err
+		}
+		if len(retentionPolicy) > 0 && retentionPolicy != "autogen" {
+			query := fmt.Sprintf("CREATE RETENTION POLICY %q ON %q DURATION INF REPLICATION 1", retentionPolicy, database)
+			if err := influxDB.queryV1(query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newWriteAPIV1 creates a v1 write API, which sends the buffered lines every
+// v1FlushInterval, until it is closed
+func newWriteAPIV1(influxDB *InfluxDBConf) *writeAPIV1 {
+	database, retentionPolicy := splitBucketV1(influxDB.bucket)
+	w := &writeAPIV1{
+		host:            influxDB.host,
+		database:        database,
+		retentionPolicy: retentionPolicy,
+		user:            influxDB.user,
+		password:        influxDB.password,
+		onError:         influxDB.writeError,
+		done:            make(chan bool),
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(v1FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Flush()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// add a line and send the batch, if it is full
+func (w *writeAPIV1) addLine(writeLine func(*strings.Builder)) {
+	w.lock.Lock()
+	writeLine(&w.lines)
+	w.numLines++
+	numLines := w.numLines
+	w.lock.Unlock()
+
+	if numLines >= v1BatchSize {
+		w.Flush()
+	}
+}
+
+func (w *writeAPIV1) WriteRecord(line string) {
+	w.addLine(func(lines *strings.Builder) {
+		lines.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			lines.WriteString("\n")
+		}
+	})
+}
+
+// WritePoint adds the point as line. InfluxDB 1.x rejects unsigned integer
+// fields by default, so they are written as signed integers.
+func (w *writeAPIV1) WritePoint(point *write.Point) {
+	for _, field := range point.FieldList() {
+		if value, ok := field.Value.(uint64); ok {
+			field.Value = int64(value)
+		}
+	}
+	w.addLine(func(lines *strings.Builder) {
+		write.PointToLineProtocolBuffer(point, lines, time.Millisecond)
+	})
+}
+
+// Flush sends all buffered lines. Errors are reported to onError.
+func (w *writeAPIV1) Flush() {
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+
+	w.lock.Lock()
+	body := w.lines.String()
+	numLines := w.numLines
+	w.lines.Reset()
+	w.numLines = 0
+	w.lock.Unlock()
+
+	if numLines == 0 {
+		return
+	}
+	if err := w.send(body); err != nil {
+		metrics.PointsFailed.Add(int64(numLines))
+		w.onError(err)
+		return
+	}
+	metrics.PointsWritten.Add(int64(numLines))
+}
+
+// Close stops the flush ticker and sends the remaining lines
+func (w *writeAPIV1) Close() {
+	close(w.done)
+	w.wg.Wait()
+	w.Flush()
+}
+
+func (w *writeAPIV1) send(body string) error {
+	params := url.Values{}
+	params.Set("db", w.database)
+	if len(w.retentionPolicy) > 0 {
+		params.Set("rp", w.retentionPolicy)
+	}
+	params.Set("precision", "ms")
+
+	req, err := http.NewRequest("POST", w.host+"/write?"+params.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(w.user) > 0 {
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	resp, err := v1Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("v1 write: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Errors returns no channel, as errors are reported by Flush
+func (w *writeAPIV1) Errors() <-chan error {
+	return nil
+}
+
+func (w *writeAPIV1) SetWriteFailedCallback(cb api.WriteFailedCallback) {
+	// failed batches are not retried
+}
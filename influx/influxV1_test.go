@@ -0,0 +1,140 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package influx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v1Request is a request received by the /write stand-in
+type v1Request struct {
+	query string
+	user  string
+	body  string
+}
+
+// start a v1 /write stand-in, which answers with status
+func newV1Server(t *testing.T, status int) (*httptest.Server, chan v1Request) {
+	requests := make(chan v1Request, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		user, _, _ := r.BasicAuth()
+		requests <- v1Request{r.URL.RawQuery, user, string(body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestWriteV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"written", http.StatusNoContent, false},
+		{"rejected", http.StatusBadRequest, true},
+	}
+	unsigned := regexp.MustCompile(`=[0-9]+u\b`)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newV1Server(t, test.status)
+			influxDB, err := NewV1(server.URL, "nfinflux", "secret", "flows/week")
+			if err != nil {
+				t.Fatal(err)
+			}
+			written, failed := metrics.PointsWritten.Value(), metrics.PointsFailed.Value()
+			influxDB.StartWrite()
+			influxDB.InsertStat(time.UnixMilli(1646265600000), "live", "1", 300,
+				nffile.StatRecord{NumflowsTcp: 10, NumpacketsTcp: 20, NumbytesTcp: 30, Numflows: 10})
+			err = influxDB.EndWrite()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("EndWrite: %v, want error %v", err, test.wantErr)
+			}
+
+			request := <-requests
+			if request.query != "db=flows&precision=ms&rp=week" || request.user != "nfinflux" {
+				t.Errorf("query %q, user %q", request.query, request.user)
+			}
+			if line := unsigned.FindString(request.body); len(line) > 0 {
+				t.Errorf("unsigned field %s in %q", line, request.body)
+			}
+			want := "stat,channel=live,proto=tcp bytes=30i,flows=10i,interval=300i,packets=20i 1646265600000\n"
+			if !strings.HasPrefix(request.body, want) {
+				t.Errorf("body %q, want prefix %q", request.body, want)
+			}
+
+			// all lines of the request count as written or failed
+			numLines := int64(strings.Count(request.body, "\n"))
+			wantWritten, wantFailed := numLines, int64(0)
+			if test.wantErr {
+				wantWritten, wantFailed = 0, numLines
+			}
+			if got := metrics.PointsWritten.Value() - written; got != wantWritten {
+				t.Errorf("points written %d, want %d", got, wantWritten)
+			}
+			if got := metrics.PointsFailed.Value() - failed; got != wantFailed {
+				t.Errorf("points failed %d, want %d", got, wantFailed)
+			}
+		})
+	}
+}
+
+func TestFlushIntervalV1(t *testing.T) {
+	server, requests := newV1Server(t, http.StatusNoContent)
+	influxDB, err := NewV1(server.URL, "", "", "flows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	influxDB.StartWrite()
+	defer influxDB.EndWrite()
+	influxDB.InsertStatus(time.UnixMilli(1646265600000), "live", "1", false, 3)
+
+	// the point is sent without EndWrite by the flush ticker
+	select {
+	case request := <-requests:
+		if !strings.HasPrefix(request.body, "collector_status,channel=live,exporter=1 missed=3i,up=false") {
+			t.Errorf("body %q", request.body)
+		}
+	case <-time.After(5 * v1FlushInterval):
+		t.Fatalf("no flush within %v", 5*v1FlushInterval)
+	}
+}
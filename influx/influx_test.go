@@ -0,0 +1,92 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package influx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPointCounter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"written", http.StatusNoContent},
+		{"rejected", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bodies := make(chan string, 16)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v2/write" {
+					t.Errorf("unexpected path %s", r.URL.Path)
+				}
+				body, _ := io.ReadAll(r.Body)
+				bodies <- string(body)
+				w.WriteHeader(test.status)
+			}))
+			t.Cleanup(server.Close)
+
+			influxDB, err := New(server.URL, "org", "token", "flows", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer influxDB.Close()
+			written, failed := metrics.PointsWritten.Value(), metrics.PointsFailed.Value()
+			influxDB.StartWrite()
+			influxDB.InsertStat(time.UnixMilli(1646265600000), "live", "1", 300, nffile.StatRecord{NumflowsTcp: 10, Numflows: 10})
+			influxDB.EndWrite()
+
+			// the body reaches the server unchanged
+			body := <-bodies
+			if !strings.HasPrefix(body, "stat,channel=live,proto=tcp ") {
+				t.Errorf("body %q", body)
+			}
+			numLines := int64(strings.Count(body, "\n"))
+			wantWritten, wantFailed := numLines, int64(0)
+			if test.status != http.StatusNoContent {
+				wantWritten, wantFailed = 0, numLines
+			}
+			if got := metrics.PointsWritten.Value() - written; got != wantWritten {
+				t.Errorf("points written %d, want %d", got, wantWritten)
+			}
+			if got := metrics.PointsFailed.Value() - failed; got != wantFailed {
+				t.Errorf("points failed %d, want %d", got, wantFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * schema defines the layout of the stat points. With the proto layout, one
+ * point per proto is written with proto as tag. With the wide layout, one point
+ * per channel is written with the fields <proto>_<field> e.g. tcp_flows.
+ */
+
+package influx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	LayoutProto = "proto"
+	LayoutWide  = "wide"
+	LayoutBoth  = "both"
+)
+
+type Schema struct {
+	// proto, wide or both
+	Layout string
+	// measurement of the proto points and of the wide points
+	Measurement     string
+	WideMeasurement string
+	// names of the fields flows, packets and bytes
+	FieldNames map[string]string
+	// static tags added to all points
+	Tags map[string]string
+}
+
+// DefaultSchema returns the schema of one point per proto in measurement stat
+func DefaultSchema() Schema {
+	return Schema{
+		Layout:          LayoutProto,
+		Measurement:     "stat",
+		WideMeasurement: "stat_wide",
+	}
+}
+
+// SetSchema sets the layout of the stat points
+func (influxDB *InfluxDBConf) SetSchema(schema Schema) error {
+	switch schema.Layout {
+	case LayoutProto, LayoutWide, LayoutBoth:
+	default:
+		return fmt.Errorf("unknown schema layout: %s", schema.Layout)
+	}
+	if len(schema.Measurement) == 0 || len(schema.WideMeasurement) == 0 {
+		return fmt.Errorf("empty measurement name")
+	}
+	for field, name := range schema.FieldNames {
+		switch field {
+		case "flows", "packets", "bytes":
+		default:
+			return fmt.Errorf("unknown field: %s", field)
+		}
+		if len(name) == 0 {
+			return fmt.Errorf("empty name for field %s", field)
+		}
+	}
+	for tag := range schema.Tags {
+		switch tag {
+		case "channel", "exporter", "proto", "metric":
+			return fmt.Errorf("static tag %s conflicts with a point tag", tag)
+		}
+	}
+	influxDB.schema = schema
+	return nil
+}
+
+// name of the field flows, packets or bytes
+func (influxDB *InfluxDBConf) fieldName(field string) string {
+	if name, ok := influxDB.schema.FieldNames[field]; ok {
+		return name
+	}
+	return field
+}
+
+// create a point with the static tags of the schema
+func (influxDB *InfluxDBConf) newPoint(measurement string, tags map[string]string, fields map[string]interface{}, when time.Time) *write.Point {
+	for tag, value := range influxDB.schema.Tags {
+		tags[tag] = value
+	}
+	return write.NewPoint(measurement, tags, fields, when)
+}
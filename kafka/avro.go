@@ -0,0 +1,86 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package kafka
+
+import (
+	"encoding/binary"
+)
+
+// AvroSchema is the writer schema of Avro encoded messages
+const AvroSchema = `{
+  "type": "record",
+  "name": "Stat",
+  "namespace": "nfinflux",
+  "fields": [
+    {"name": "time", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "channel", "type": "string"},
+    {"name": "exporter", "type": "string"},
+    {"name": "tcp", "type": {"type": "record", "name": "Counters", "fields": [
+      {"name": "flows", "type": "long"},
+      {"name": "packets", "type": "long"},
+      {"name": "bytes", "type": "long"}
+    ]}},
+    {"name": "udp", "type": "Counters"},
+    {"name": "icmp", "type": "Counters"},
+    {"name": "other", "type": "Counters"},
+    {"name": "interval", "type": "int", "default": 0}
+  ]
+}`
+
+// Avro long: zigzag encoded varint
+func appendLong(buf []byte, v int64) []byte {
+	return binary.AppendVarint(buf, v)
+}
+
+// Avro string: length followed by the UTF-8 bytes
+func appendString(buf []byte, s string) []byte {
+	buf = appendLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+func appendCounters(buf []byte, counters protoCounters) []byte {
+	buf = appendLong(buf, int64(counters.Flows))
+	buf = appendLong(buf, int64(counters.Packets))
+	return appendLong(buf, int64(counters.Bytes))
+}
+
+// encode a message in Avro binary encoding according to AvroSchema
+func encodeAvro(msg *message) []byte {
+	buf := make([]byte, 0, 128)
+	buf = appendLong(buf, msg.Time)
+	buf = appendString(buf, msg.Channel)
+	buf = appendString(buf, msg.Exporter)
+	buf = appendCounters(buf, msg.Tcp)
+	buf = appendCounters(buf, msg.Udp)
+	buf = appendCounters(buf, msg.Icmp)
+	buf = appendCounters(buf, msg.Other)
+	// Avro int uses the same varint encoding as long
+	return appendLong(buf, int64(msg.Interval))
+}
@@ -0,0 +1,209 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * kafka publishes each stat record as JSON or Avro message to a Kafka topic.
+ * Messages are keyed by channel/exporter, so all records of a series end up
+ * in the same partition.
+ */
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"strings"
+	"sync"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+type protoCounters struct {
+	Flows   uint64 `json:"flows"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+type message struct {
+	Time     int64         `json:"time"`
+	Channel  string        `json:"channel"`
+	Exporter string        `json:"exporter"`
+	Interval int           `json:"interval"`
+	Tcp      protoCounters `json:"tcp"`
+	Udp      protoCounters `json:"udp"`
+	Icmp     protoCounters `json:"icmp"`
+	Other    protoCounters `json:"other"`
+}
+
+// MessageWriter is implemented by kafka-go's Writer. It may be replaced
+// by a fake for testing without a broker.
+type MessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+type KafkaConf struct {
+	format string
+	writer MessageWriter
+	// async writers report the delivery to the completion callback
+	async    bool
+	closed   bool
+	lock     sync.Mutex
+	errCount int
+}
+
+var compressionCodecs = map[string]kafkago.Compression{
+	"gzip":   kafkago.Gzip,
+	"snappy": kafkago.Snappy,
+	"lz4":    kafkago.Lz4,
+	"zstd":   kafkago.Zstd,
+}
+
+// New creates a Kafka producer for the comma separated list of brokers. format is
+// "json" or "avro", compression "none", "gzip", "snappy", "lz4" or "zstd". acks is
+// the number of required acknowledgements: 0 none, 1 leader, -1 all in-sync replicas.
+func New(brokers string, topic string, format string, compression string, acks int) (*KafkaConf, error) {
+	if format != "json" && format != "avro" {
+		return nil, fmt.Errorf("kafka: unsupported message format: %s", format)
+	}
+
+	writer := &kafkago.Writer{
+		Addr:         kafkago.TCP(strings.Split(brokers, ",")...),
+		Topic:        topic,
+		Balancer:     &kafkago.Hash{},
+		BatchSize:    1000,
+		BatchTimeout: time.Second,
+		RequiredAcks: kafkago.RequiredAcks(acks),
+		Async:        true,
+	}
+	if compression != "none" {
+		codec, ok := compressionCodecs[compression]
+		if !ok {
+			return nil, fmt.Errorf("kafka: unsupported compression: %s", compression)
+		}
+		writer.Compression = codec
+	}
+
+	kafkaConf := NewWithWriter(writer, format)
+	kafkaConf.async = true
+	// delivery reports of async writes
+	writer.Completion = func(messages []kafkago.Message, err error) {
+		if err != nil {
+			kafkaConf.writeError(len(messages), err)
+			return
+		}
+		metrics.PointsWritten.Add(int64(len(messages)))
+	}
+	return kafkaConf, nil
+} // End of New
+
+// NewWithWriter creates a Kafka output, which uses writer to publish messages
+func NewWithWriter(writer MessageWriter, format string) *KafkaConf {
+	kafkaConf := new(KafkaConf)
+	kafkaConf.writer = writer
+	kafkaConf.format = format
+	return kafkaConf
+}
+
+func (kafkaConf *KafkaConf) writeError(numMessages int, err error) {
+	fmt.Printf("kafka write error: %v\n", err)
+	metrics.WriteErrors.Add(1)
+	metrics.PointsFailed.Add(int64(numMessages))
+	kafkaConf.lock.Lock()
+	kafkaConf.errCount += numMessages
+	kafkaConf.lock.Unlock()
+}
+
+func (kafkaConf *KafkaConf) StartWrite() error {
+	return nil
+}
+
+func (kafkaConf *KafkaConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	msg := message{
+		Time:     when.UnixMilli(),
+		Channel:  ident,
+		Exporter: exporterID,
+		Interval: interval,
+		Tcp:      protoCounters{statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp},
+		Udp:      protoCounters{statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp},
+		Icmp:     protoCounters{statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp},
+		Other:    protoCounters{statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther},
+	}
+
+	var value []byte
+	if kafkaConf.format == "avro" {
+		value = encodeAvro(&msg)
+	} else {
+		var err error
+		if value, err = json.Marshal(&msg); err != nil {
+			kafkaConf.writeError(1, err)
+			return
+		}
+	}
+
+	kafkaMsg := kafkago.Message{
+		Key:   []byte(msg.Channel + "/" + exporterID),
+		Value: value,
+		Time:  when,
+	}
+	if err := kafkaConf.writer.WriteMessages(context.Background(), kafkaMsg); err != nil {
+		kafkaConf.writeError(1, err)
+	} else if !kafkaConf.async {
+		metrics.PointsWritten.Add(1)
+	}
+}
+
+// EndWrite waits for all pending messages to be delivered and reports
+// the number of messages, which failed
+func (kafkaConf *KafkaConf) EndWrite() error {
+	// the producer has no flush - closing waits for pending writes
+	if err := kafkaConf.Close(); err != nil {
+		return err
+	}
+
+	kafkaConf.lock.Lock()
+	defer kafkaConf.lock.Unlock()
+	if kafkaConf.errCount > 0 {
+		return fmt.Errorf("kafka failed messages: %d", kafkaConf.errCount)
+	}
+	return nil
+}
+
+// Close flushes all pending messages and closes the producer
+func (kafkaConf *KafkaConf) Close() error {
+	if kafkaConf.closed {
+		return nil
+	}
+	kafkaConf.closed = true
+	return kafkaConf.writer.Close()
+}
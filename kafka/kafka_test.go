@@ -0,0 +1,112 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"nfinflux/nffile"
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// testWriter collects the messages instead of publishing them to a broker
+type testWriter struct {
+	messages []kafkago.Message
+	err      error
+	closed   bool
+}
+
+func (writer *testWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	if writer.err != nil {
+		return writer.err
+	}
+	writer.messages = append(writer.messages, msgs...)
+	return nil
+}
+
+func (writer *testWriter) Close() error {
+	writer.closed = true
+	return nil
+}
+
+func TestInsertStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"delivered", nil, false},
+		{"write error", errors.New("broker down"), true},
+	}
+	when := time.UnixMilli(1646265600000)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := &testWriter{err: test.err}
+			kafkaConf := NewWithWriter(writer, "json")
+			kafkaConf.InsertStat(when, "live", "1", 300, nffile.StatRecord{NumflowsTcp: 10, NumpacketsUdp: 20, NumbytesIcmp: 30})
+			err := kafkaConf.EndWrite()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("EndWrite: %v, want error %v", err, test.wantErr)
+			}
+			if !writer.closed {
+				t.Errorf("EndWrite did not close the writer")
+			}
+			if test.wantErr {
+				return
+			}
+			if len(writer.messages) != 1 {
+				t.Fatalf("got %d messages, want 1", len(writer.messages))
+			}
+			if key := string(writer.messages[0].Key); key != "live/1" {
+				t.Errorf("key %q, want %q", key, "live/1")
+			}
+			var msg message
+			if err := json.Unmarshal(writer.messages[0].Value, &msg); err != nil {
+				t.Fatalf("decode message: %v", err)
+			}
+			want := message{
+				Time:     when.UnixMilli(),
+				Channel:  "live",
+				Exporter: "1",
+				Interval: 300,
+				Tcp:      protoCounters{Flows: 10},
+				Udp:      protoCounters{Packets: 20},
+				Icmp:     protoCounters{Bytes: 30},
+			}
+			if msg != want {
+				t.Errorf("message %+v, want %+v", msg, want)
+			}
+		})
+	}
+}
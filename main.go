@@ -32,57 +32,161 @@ package main
 import (
 	"flag"
 	"fmt"
-	"nfinflux/influx"
+	"nfinflux/config"
+	"nfinflux/metrics"
 	"nfinflux/nfsocket"
+	"nfinflux/output"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// split a comma separated list
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
 func main() {
-	var defaultHost = "http://127.0.0.1:8086"
-	var defaultToken string
+	opts := newOptions()
+	opts.register(flag.CommandLine)
+	flag.Parse()
 
-	// get env variables, if set
-	if len(os.Getenv("INFLUXDB_URL")) > 0 {
-		defaultHost = os.Getenv("INFLUXDB_URL")
+	// options on the command line and env variables override the config file
+	conf := &config.Config{}
+	if len(opts.config) > 0 {
+		var err error
+		if conf, err = config.Load(opts.config); err != nil {
+			fmt.Printf("Error reading config file: %v\n", err)
+			os.Exit(255)
+		}
+		if err := applyFile(flag.CommandLine, conf.Options); err != nil {
+			fmt.Printf("Error config file %s: %v\n", opts.config, err)
+			os.Exit(255)
+		}
 	}
 
-	if len(os.Getenv("INFLUXDB_TOKEN")) > 0 {
-		defaultToken = os.Getenv("INFLUXDB_TOKEN")
+	var listeners []string
+	if len(opts.socketPath) > 0 {
+		listeners = append(listeners, "unix://"+opts.socketPath)
+	}
+	listeners = append(listeners, splitList(opts.listenAddrs)...)
+	var watches, imports []config.Input
+	if watchDirs := splitList(opts.watchDirs); len(watchDirs) > 0 {
+		watches = append(watches, config.Input{Watch: watchDirs})
+	}
+	for _, input := range conf.Inputs {
+		listeners = append(listeners, input.Listen...)
+		if len(input.Watch) > 0 {
+			watches = append(watches, input)
+		}
+		if len(input.Import) > 0 {
+			imports = append(imports, input)
+		}
+	}
+	socketMode := len(listeners) > 0
+	liveMode := socketMode || len(watches) > 0
+	if len(flag.Args()) > 0 || (!liveMode && len(imports) == 0) {
+		imports = append(imports, config.Input{Import: flag.Args()})
 	}
 
-	var (
-		influxHost   = flag.String("host", defaultHost, "Address to send metric data")
-		org          = flag.String("org", "Netflow", "influxDB organisation name")
-		bucket       = flag.String("bucket", "life", "influxDB bucket name")
-		token        = flag.String("token", defaultToken, "influxDB token")
-		socketPath   = flag.String("socket", "", "Path for nfcapd collectors to connect")
-		createBucket = flag.Bool("create", false, "create bucket, if it does not exist")
-		cleanBucket  = flag.Bool("delete", false, "delete existing bucket first")
-		twin         = flag.Int("twin", 300, "time interval in seconds of flow file")
-	)
-
-	flag.Parse()
-
-	influxDB, err := influx.New(*influxHost, *org, *token, *createBucket || *cleanBucket)
+	listenOptions, err := setupListenOptions(opts.socketOwner, opts.socketGroup, opts.socketPerm, opts.allowUIDs, opts.allowGIDs)
 	if err != nil {
-		fmt.Printf("Error setup influxDB at %s: %v\n", *influxHost, err)
-		if *createBucket || *cleanBucket {
-			fmt.Printf("Make sure your DB parameters are correct and your token is authorized to create/delete buckets\n")
-		}
+		fmt.Printf("Error setup socket options: %v\n", err)
 		os.Exit(255)
 	}
-	if _, err := influxDB.VerifyBucket(*bucket, *createBucket, *cleanBucket); err != nil {
-		fmt.Printf("Failed to veryfy bucket '%s': %v\n", *bucket, err)
-		influxDB.Close()
+	listenOptions.MaxMissed = opts.maxMissed
+	switch opts.counters {
+	case "rate":
+	case "absolute":
+		listenOptions.AbsoluteCounters = true
+	default:
+		fmt.Printf("Unknown counters: %s\n", opts.counters)
+		os.Exit(255)
+	}
+	if len(opts.tlsCert) > 0 {
+		tlsConfig, err := nfsocket.NewTLSConfig(opts.tlsCert, opts.tlsKey, opts.tlsCA)
+		if err != nil {
+			fmt.Printf("Error setup TLS: %v\n", err)
+			os.Exit(255)
+		}
+		certIdents, err := nfsocket.ParseCertIdents(opts.tlsIdents)
+		if err != nil {
+			fmt.Printf("Error setup TLS: %v\n", err)
+			os.Exit(255)
+		}
+		listenOptions.TLS = tlsConfig
+		listenOptions.CertIdents = certIdents
+	}
+
+	writers, err := setupPipeline(opts, conf, liveMode)
+	if err != nil {
+		fmt.Printf("Error setup outputs: %v\n", err)
 		os.Exit(255)
 	}
 
-	if len(*socketPath) > 0 {
-		nfsocket.SetupSocketFeeder(socketPath, *bucket, influxDB)
-	} else {
-		scanDirs := flag.Args()
-		setupFileFeeder(scanDirs, *bucket, *twin, influxDB)
+	// all inputs feed the same outputs, which are started and ended once
+	shared := output.NewSharedWriter(writers)
+	if err := shared.StartWrite(); err != nil {
+		fmt.Printf("Start write: %v\n", err)
 	}
 
-	influxDB.Close()
+	if liveMode {
+		setupReloadHandler(conf, shared)
+	}
+	if len(opts.statsListen) > 0 {
+		setupStatsServer(opts.statsListen)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for _, input := range watches {
+		twin := opts.twin
+		if input.Twin > 0 {
+			twin = input.Twin
+		}
+		wg.Add(1)
+		go func(watchDirs []string, twin int) {
+			setupDirWatcher(watchDirs, twin, shared, done)
+			wg.Done()
+		}(input.Watch, twin)
+	}
+	if liveMode && opts.statsInterval > 0 {
+		go setupStatsWriter(shared, opts.statsInterval, done)
+	}
+	wg.Add(1)
+	go func() {
+		for _, input := range imports {
+			twin := opts.twin
+			if input.Twin > 0 {
+				twin = input.Twin
+			}
+			setupFileFeeder(input.Import, twin, shared)
+		}
+		wg.Done()
+	}()
+
+	if socketMode {
+		nfsocket.SetupSocketFeeder(listeners, listenOptions, shared)
+		close(done)
+	} else if len(watches) > 0 {
+		<-nfsocket.SetupCloseHandler(nil)
+		close(done)
+	}
+	wg.Wait()
+
+	// final internal counters of this run
+	if opts.statsInterval > 0 {
+		shared.InsertInternal(time.Now(), metrics.Values())
+	}
+	if err := shared.EndWrite(); err != nil {
+		fmt.Printf("Insert stat record(s): %v\n", err)
+	}
+	shared.Close()
 }
@@ -0,0 +1,105 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * metrics counts the internal events of nfinflux. The counters are served as
+ * JSON by the stats server and written periodically as internal points.
+ */
+
+package metrics
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+var (
+	// Connections counts the accepted collector connections and UDP datagrams
+	Connections expvar.Int
+	// Messages counts the decoded metric messages
+	Messages expvar.Int
+	// ParseErrors counts the invalid metric messages
+	ParseErrors expvar.Int
+	// PointsWritten counts the points accepted by the outputs, a point being
+	// a line, row, message or data point of the output
+	PointsWritten expvar.Int
+	// PointsFailed counts the points of failed writes
+	PointsFailed expvar.Int
+	// WriteErrors counts the failed writes of all outputs
+	WriteErrors expvar.Int
+	// Files counts the imported flow files
+	Files expvar.Int
+)
+
+// length of the metric queue of the feeder, a func() int
+var queueDepth atomic.Value
+
+// SetQueueDepth registers the length of the metric queue. It is read, when
+// the counters are served or written.
+func SetQueueDepth(depth func() int) {
+	queueDepth.Store(depth)
+}
+
+// the map is not published, as expvar serves the command line with it
+var counters = new(expvar.Map).Init()
+
+func init() {
+	counters.Set("connections", &Connections)
+	counters.Set("messages", &Messages)
+	counters.Set("parse_errors", &ParseErrors)
+	counters.Set("queue_depth", expvar.Func(func() any {
+		if depth, ok := queueDepth.Load().(func() int); ok {
+			return int64(depth())
+		}
+		return int64(0)
+	}))
+	counters.Set("points_written", &PointsWritten)
+	counters.Set("points_failed", &PointsFailed)
+	counters.Set("write_errors", &WriteErrors)
+	counters.Set("files", &Files)
+}
+
+// String returns all counters as JSON object
+func String() string {
+	return counters.String()
+}
+
+// Values returns the current values of all counters
+func Values() map[string]int64 {
+	values := make(map[string]int64)
+	counters.Do(func(kv expvar.KeyValue) {
+		switch counter := kv.Value.(type) {
+		case *expvar.Int:
+			values[kv.Key] = counter.Value()
+		case expvar.Func:
+			values[kv.Key] = counter.Value().(int64)
+		}
+	})
+	return values
+}
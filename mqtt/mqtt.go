@@ -0,0 +1,236 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * mqtt publishes the stat records to an MQTT broker as retained messages
+ * under the topic <prefix>/<channel>/<exporter>/<proto>. Messages published
+ * while the broker is not reachable are buffered up to a limit and sent after
+ * the client reconnected.
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// max number of messages buffered during broker outages
+const maxPending = 10000
+
+// time to wait for a publish to complete
+const publishTimeout = 10 * time.Second
+
+type payload struct {
+	Time     int64  `json:"time"`
+	Interval int    `json:"interval"`
+	Flows    uint64 `json:"flows"`
+	Packets  uint64 `json:"packets"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+type pendingMsg struct {
+	topic   string
+	payload []byte
+}
+
+type MqttConf struct {
+	prefix   string
+	qos      byte
+	retained bool
+	client   paho.Client
+	lock     sync.Mutex
+	pending  []pendingMsg
+	dropped  int
+	errCount int
+	inFlight sync.WaitGroup
+}
+
+// number of clients created, so each client of a reload gets its own client ID.
+// A broker disconnects a client, when another one connects with the same ID.
+var numClients atomic.Int64
+
+// New creates an MQTT output connecting to broker e.g. tcp://127.0.0.1:1883.
+// user and password may be empty.
+func New(broker string, prefix string, qos int, retained bool, user string, password string) (*MqttConf, error) {
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("mqtt: invalid QoS: %d", qos)
+	}
+
+	mqttConf := new(MqttConf)
+	mqttConf.prefix = strings.Trim(prefix, "/")
+	mqttConf.qos = byte(qos)
+	mqttConf.retained = retained
+
+	hostname, _ := os.Hostname()
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(fmt.Sprintf("nfinflux-%s-%d-%d", hostname, os.Getpid(), numClients.Add(1))).
+		SetUsername(user).
+		SetPassword(password).
+		SetConnectTimeout(10 * time.Second).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetConnectionLostHandler(func(client paho.Client, err error) {
+			fmt.Printf("mqtt connection lost: %v\n", err)
+		}).
+		SetOnConnectHandler(func(client paho.Client) {
+			mqttConf.publishPending()
+		})
+	mqttConf.client = paho.NewClient(opts)
+	return mqttConf, nil
+} // End of New
+
+// topic level of an ident or exporter
+func sanitize(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch c {
+		case '/', '+', '#':
+			return '_'
+		}
+		return c
+	}, name)
+	if len(name) == 0 {
+		return "unknown"
+	}
+	return name
+}
+
+func (mqttConf *MqttConf) StartWrite() error {
+	// with connect retry, Connect keeps retrying in background. Give the initial
+	// connect some time, otherwise messages are buffered until connected.
+	token := mqttConf.client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		fmt.Printf("mqtt broker not reachable - buffer messages\n")
+	}
+	return nil
+}
+
+func (mqttConf *MqttConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	topic := sanitize(ident) + "/" + sanitize(exporterID)
+	if len(mqttConf.prefix) > 0 {
+		topic = mqttConf.prefix + "/" + topic
+	}
+
+	msec := when.UnixMilli()
+	protos := [4]string{"tcp", "udp", "icmp", "other"}
+	payloads := [4]payload{
+		{msec, interval, statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp},
+		{msec, interval, statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp},
+		{msec, interval, statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp},
+		{msec, interval, statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther},
+	}
+	for i, proto := range protos {
+		data, _ := json.Marshal(&payloads[i])
+		mqttConf.publish(pendingMsg{topic + "/" + proto, data})
+	}
+}
+
+// publish message or buffer it, if not connected
+func (mqttConf *MqttConf) publish(msg pendingMsg) {
+	if !mqttConf.client.IsConnectionOpen() {
+		mqttConf.lock.Lock()
+		if len(mqttConf.pending) >= maxPending {
+			// drop oldest message
+			mqttConf.pending = mqttConf.pending[1:]
+			mqttConf.dropped++
+			metrics.PointsFailed.Add(1)
+		}
+		mqttConf.pending = append(mqttConf.pending, msg)
+		mqttConf.lock.Unlock()
+		return
+	}
+
+	token := mqttConf.client.Publish(msg.topic, mqttConf.qos, mqttConf.retained, msg.payload)
+	mqttConf.inFlight.Add(1)
+	go func() {
+		defer mqttConf.inFlight.Done()
+		if !token.WaitTimeout(publishTimeout) {
+			mqttConf.publishError(fmt.Errorf("publish %s timed out", msg.topic))
+		} else if err := token.Error(); err != nil {
+			mqttConf.publishError(err)
+		} else {
+			metrics.PointsWritten.Add(1)
+		}
+	}()
+}
+
+func (mqttConf *MqttConf) publishError(err error) {
+	fmt.Printf("mqtt publish error: %v\n", err)
+	metrics.WriteErrors.Add(1)
+	metrics.PointsFailed.Add(1)
+	mqttConf.lock.Lock()
+	mqttConf.errCount++
+	mqttConf.lock.Unlock()
+}
+
+// send all messages buffered during the outage
+func (mqttConf *MqttConf) publishPending() {
+	mqttConf.lock.Lock()
+	pending := mqttConf.pending
+	mqttConf.pending = nil
+	if mqttConf.dropped > 0 {
+		fmt.Printf("mqtt dropped %d messages during broker outage\n", mqttConf.dropped)
+		mqttConf.dropped = 0
+	}
+	mqttConf.lock.Unlock()
+
+	for _, msg := range pending {
+		mqttConf.publish(msg)
+	}
+}
+
+// EndWrite reports failed and still buffered messages
+func (mqttConf *MqttConf) EndWrite() error {
+	mqttConf.inFlight.Wait()
+
+	mqttConf.lock.Lock()
+	defer mqttConf.lock.Unlock()
+	numFailed := mqttConf.errCount + mqttConf.dropped + len(mqttConf.pending)
+	if numFailed > 0 {
+		return fmt.Errorf("mqtt failed messages: %d", numFailed)
+	}
+	return nil
+}
+
+func (mqttConf *MqttConf) Close() error {
+	// wait up to 1s for in-flight messages
+	mqttConf.client.Disconnect(1000)
+	return nil
+}
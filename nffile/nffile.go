@@ -35,6 +35,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
 type NfFile struct {
@@ -122,6 +123,35 @@ type StatRecord struct {
 	SequenceFailure uint64
 }
 
+// create the rate e.g. values/s for fps, pps and bps
+func CalculateRate(stat *StatRecord, rate uint64) {
+	stat.Numflows /= rate
+	stat.Numbytes /= rate
+	stat.Numpackets /= rate
+	// flow stat
+	stat.NumflowsTcp /= rate
+	stat.NumflowsUdp /= rate
+	stat.NumflowsIcmp /= rate
+	stat.NumflowsOther /= rate
+	// bytes stat
+	stat.NumbytesTcp /= rate
+	stat.NumbytesUdp /= rate
+	stat.NumbytesIcmp /= rate
+	stat.NumbytesOther /= rate
+	// packet stat
+	stat.NumpacketsTcp /= rate
+	stat.NumpacketsUdp /= rate
+	stat.NumpacketsIcmp /= rate
+	stat.NumpacketsOther /= rate
+}
+
+// calculate the overall counters from the per proto counters
+func CalculateTotals(stat *StatRecord) {
+	stat.Numflows = stat.NumflowsTcp + stat.NumflowsUdp + stat.NumflowsIcmp + stat.NumflowsOther
+	stat.Numbytes = stat.NumbytesTcp + stat.NumbytesUdp + stat.NumbytesIcmp + stat.NumbytesOther
+	stat.Numpackets = stat.NumpacketsTcp + stat.NumpacketsUdp + stat.NumpacketsIcmp + stat.NumpacketsOther
+}
+
 const TYPE_IDENT = 0x8001
 const TYPE_STAT = 0x8002
 
@@ -236,8 +266,9 @@ func (nfFile *NfFile) Close() error {
 	return nil
 }
 
+// Ident returns the ident of the file without the zero padding of the header
 func (nfFile *NfFile) Ident() string {
-	return nfFile.ident
+	return strings.TrimRight(nfFile.ident, "\x00")
 }
 
 func (nfFile *NfFile) Stat() StatRecord {
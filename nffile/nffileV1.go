@@ -132,8 +132,8 @@ func (nfFile *NfFile) openV1() error {
 	nfFile.StatRecord.NumbytesIcmp = statRecordV1.NumbytesIcmp
 	nfFile.StatRecord.NumbytesOther = statRecordV1.NumbytesOther
 
-	nfFile.StatRecord.FirstSeen = uint64(statRecordV1.FirstSeen*1000 + uint32(statRecordV1.MsecFirst))
-	nfFile.StatRecord.LastSeen = uint64(statRecordV1.LastSeen*1000 + uint32(statRecordV1.MsecLast))
+	nfFile.StatRecord.FirstSeen = uint64(statRecordV1.FirstSeen)*1000 + uint64(statRecordV1.MsecFirst)
+	nfFile.StatRecord.LastSeen = uint64(statRecordV1.LastSeen)*1000 + uint64(statRecordV1.MsecLast)
 
 	nfFile.StatRecord.SequenceFailure = uint64(statRecordV1.SequenceFailure)
 	nfFile.ident = string(nfFileV1Header.Ident[:])
@@ -0,0 +1,128 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * counter tracks the last metric record per channel and exporter, to detect
+ * collector restarts and to convert absolute counters into rates/s
+ */
+
+package nfsocket
+
+import (
+	"fmt"
+	"nfinflux/nffile"
+	"time"
+)
+
+type counterKey struct {
+	ident    string
+	exporter int
+}
+
+type counterState struct {
+	timestamp uint64
+	uptime    uint64
+	stat      nffile.StatRecord
+}
+
+type counterTracker map[counterKey]*counterState
+
+// update checks metric against the last record of the same channel and exporter.
+// A decreasing uptime signals a collector restart. With absolute counters,
+// metric.stat is replaced by the rates/s since the last record. update returns
+// false, if no rate can be calculated e.g. for the first record.
+func (tracker counterTracker) update(metric *metricInfo, absolute bool) bool {
+
+	key := counterKey{metric.ident, metric.exporter}
+	last, ok := tracker[key]
+	tracker[key] = &counterState{metric.timestamp, metric.uptime, metric.stat}
+
+	restarted := ok && metric.uptime < last.uptime
+	if restarted {
+		fmt.Printf("Collector restart detected for '%s', exporter: %d, uptime: %v\n",
+			metric.ident, metric.exporter, time.Duration(metric.uptime)*time.Millisecond)
+	}
+
+	if !absolute {
+		return true
+	}
+
+	var seconds uint64
+	switch {
+	case !ok:
+		// first record is the base for the next rate
+		return false
+	case restarted:
+		// counters since the collector restart
+		seconds = metric.uptime / 1000
+	default:
+		if !subtractStat(&metric.stat, &last.stat) {
+			fmt.Printf("Counter reset detected for '%s', exporter: %d\n", metric.ident, metric.exporter)
+			return false
+		}
+		if metric.timestamp > last.timestamp {
+			seconds = (metric.timestamp - last.timestamp) / 1000
+		} else {
+			seconds = uint64(metric.interval)
+		}
+	}
+	if seconds == 0 {
+		return false
+	}
+	nffile.CalculateRate(&metric.stat, seconds)
+	return true
+
+} // End of update
+
+// subtract the previous counters from stat. Returns false, if any counter
+// decreased, and leaves stat in an undefined state.
+func subtractStat(stat *nffile.StatRecord, prev *nffile.StatRecord) bool {
+	counters := [...][2]*uint64{
+		{&stat.NumflowsTcp, &prev.NumflowsTcp},
+		{&stat.NumflowsUdp, &prev.NumflowsUdp},
+		{&stat.NumflowsIcmp, &prev.NumflowsIcmp},
+		{&stat.NumflowsOther, &prev.NumflowsOther},
+		{&stat.NumbytesTcp, &prev.NumbytesTcp},
+		{&stat.NumbytesUdp, &prev.NumbytesUdp},
+		{&stat.NumbytesIcmp, &prev.NumbytesIcmp},
+		{&stat.NumbytesOther, &prev.NumbytesOther},
+		{&stat.NumpacketsTcp, &prev.NumpacketsTcp},
+		{&stat.NumpacketsUdp, &prev.NumpacketsUdp},
+		{&stat.NumpacketsIcmp, &prev.NumpacketsIcmp},
+		{&stat.NumpacketsOther, &prev.NumpacketsOther},
+	}
+	for _, counter := range counters {
+		if *counter[0] < *counter[1] {
+			return false
+		}
+		*counter[0] -= *counter[1]
+	}
+	return true
+
+} // End of subtractStat
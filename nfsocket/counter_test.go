@@ -0,0 +1,99 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package nfsocket
+
+import (
+	"nfinflux/nffile"
+	"testing"
+)
+
+func TestCounterUpdate(t *testing.T) {
+	type step struct {
+		timestamp uint64 // msec
+		uptime    uint64 // msec
+		flows     uint64
+		// expected result of update and the tcp flows afterwards
+		ok   bool
+		want uint64
+	}
+	tests := []struct {
+		name     string
+		absolute bool
+		steps    []step
+	}{
+		{"rate counters", false, []step{
+			{60000, 60000, 100, true, 100},
+			{120000, 120000, 50, true, 50},
+		}},
+		{"absolute counters", true, []step{
+			{60000, 60000, 6000, false, 6000},
+			{120000, 120000, 12000, true, 100},
+			{180000, 180000, 24000, true, 200},
+		}},
+		{"uptime reset", true, []step{
+			{60000, 600000, 60000, false, 60000},
+			{120000, 660000, 66000, true, 100},
+			// collector restarted 30s ago
+			{180000, 30000, 9000, true, 300},
+			{240000, 90000, 15000, true, 100},
+		}},
+		{"counter reset without uptime", true, []step{
+			{60000, 60000, 6000, false, 6000},
+			{120000, 120000, 3000, false, 3000},
+			{180000, 180000, 9000, true, 100},
+		}},
+		{"same timestamp uses interval", true, []step{
+			{60000, 60000, 6000, false, 6000},
+			{60000, 120000, 12000, true, 100},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := make(counterTracker)
+			for i, step := range test.steps {
+				metric := metricInfo{
+					timestamp: step.timestamp,
+					interval:  60,
+					uptime:    step.uptime,
+					ident:     "live",
+					exporter:  1,
+					stat:      nffile.StatRecord{NumflowsTcp: step.flows},
+				}
+				ok := tracker.update(&metric, test.absolute)
+				if ok != step.ok {
+					t.Errorf("step %d: update returned %v, want %v", i, ok, step.ok)
+				}
+				if ok && metric.stat.NumflowsTcp != step.want {
+					t.Errorf("step %d: tcp flows %d, want %d", i, metric.stat.NumflowsTcp, step.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * liveness tracks the last message of each channel and exporter. A collector,
+ * which misses a number of intervals, is reported down and reported up again,
+ * when its next message arrives.
+ */
+
+package nfsocket
+
+import (
+	"fmt"
+	"nfinflux/output"
+	"strconv"
+	"time"
+)
+
+// expected interval, if a collector does not announce it
+const defaultInterval = 60 * time.Second
+
+// how often the liveness of all collectors is checked
+const livenessCheck = 5 * time.Second
+
+type livenessState struct {
+	lastSeen time.Time
+	interval time.Duration
+	down     bool
+}
+
+type livenessTracker struct {
+	maxMissed int
+	series    map[counterKey]*livenessState
+}
+
+func newLivenessTracker(maxMissed int) *livenessTracker {
+	return &livenessTracker{
+		maxMissed: maxMissed,
+		series:    make(map[counterKey]*livenessState),
+	}
+}
+
+// seen records a message of a collector and reports its recovery, if it was down
+func (tracker *livenessTracker) seen(metric *metricInfo, now time.Time, writer output.Writer) {
+	key := counterKey{metric.ident, metric.exporter}
+	state, ok := tracker.series[key]
+	if !ok {
+		state = new(livenessState)
+		tracker.series[key] = state
+	}
+	if state.down {
+		fmt.Printf("Collector '%s', exporter: %d recovered after %v\n",
+			metric.ident, metric.exporter, now.Sub(state.lastSeen).Round(time.Second))
+		tracker.report(writer, now, key, true, 0)
+		state.down = false
+	}
+	state.lastSeen = now
+	state.interval = time.Duration(metric.interval) * time.Second
+	if state.interval == 0 {
+		state.interval = defaultInterval
+	}
+} // End of seen
+
+// check reports all collectors down, which missed maxMissed intervals
+func (tracker *livenessTracker) check(now time.Time, writer output.Writer) {
+	for key, state := range tracker.series {
+		if state.down {
+			continue
+		}
+		missed := int(now.Sub(state.lastSeen) / state.interval)
+		if missed >= tracker.maxMissed {
+			fmt.Printf("Collector '%s', exporter: %d missed %d intervals - last message at %v\n",
+				key.ident, key.exporter, missed, state.lastSeen.Format(time.RFC3339))
+			tracker.report(writer, now, key, false, missed)
+			state.down = true
+		}
+	}
+} // End of check
+
+func (tracker *livenessTracker) report(writer output.Writer, now time.Time, key counterKey, up bool, missed int) {
+	if statusWriter, ok := writer.(output.StatusWriter); ok {
+		statusWriter.InsertStatus(now, key.ident, strconv.Itoa(key.exporter), up, missed)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package nfsocket
+
+import (
+	"nfinflux/nffile"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type statusEvent struct {
+	ident    string
+	exporter string
+	up       bool
+	missed   int
+}
+
+// statusWriter records the reported status events
+type statusWriter struct {
+	events []statusEvent
+}
+
+func (writer *statusWriter) StartWrite() error { return nil }
+func (writer *statusWriter) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+}
+func (writer *statusWriter) EndWrite() error { return nil }
+func (writer *statusWriter) Close() error    { return nil }
+func (writer *statusWriter) InsertStatus(when time.Time, ident string, exporterID string, up bool, missed int) {
+	writer.events = append(writer.events, statusEvent{ident, exporterID, up, missed})
+}
+
+func TestLiveness(t *testing.T) {
+	type step struct {
+		// seconds since start
+		at int
+		// message of ident and exporter with interval, otherwise a check
+		ident    string
+		exporter int
+		interval int
+		want     []statusEvent
+	}
+	tests := []struct {
+		name      string
+		maxMissed int
+		steps     []step
+	}{
+		{"missed and recovered", 3, []step{
+			{0, "live", 1, 60, nil},
+			{179, "", 0, 0, nil},
+			{185, "", 0, 0, []statusEvent{{"live", "1", false, 3}}},
+			// reported down once
+			{300, "", 0, 0, nil},
+			{310, "live", 1, 60, []statusEvent{{"live", "1", true, 0}}},
+			{400, "", 0, 0, nil},
+		}},
+		{"default interval", 2, []step{
+			{0, "live", 1, 0, nil},
+			{100, "", 0, 0, nil},
+			{120, "", 0, 0, []statusEvent{{"live", "1", false, 2}}},
+		}},
+		{"interval of last message", 2, []step{
+			{0, "live", 1, 60, nil},
+			{60, "live", 1, 300, nil},
+			{300, "", 0, 0, nil},
+			{660, "", 0, 0, []statusEvent{{"live", "1", false, 2}}},
+		}},
+		{"per exporter", 3, []step{
+			{0, "live", 1, 60, nil},
+			{0, "live", 2, 60, nil},
+			{120, "live", 2, 60, nil},
+			{180, "", 0, 0, []statusEvent{{"live", "1", false, 3}}},
+			{300, "", 0, 0, []statusEvent{{"live", "2", false, 3}}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Unix(1700000000, 0)
+			tracker := newLivenessTracker(test.maxMissed)
+			for i, step := range test.steps {
+				writer := new(statusWriter)
+				now := start.Add(time.Duration(step.at) * time.Second)
+				if len(step.ident) > 0 {
+					metric := metricInfo{ident: step.ident, exporter: step.exporter, interval: step.interval}
+					tracker.seen(&metric, now, writer)
+				} else {
+					tracker.check(now, writer)
+				}
+				if !reflect.DeepEqual(writer.events, step.want) {
+					t.Errorf("step %d: events %v, want %v", i, writer.events, step.want)
+				}
+			}
+		})
+	}
+}
@@ -79,10 +79,15 @@ const int record_size = sizeof(metric_record_t);
 import "C"
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"nfinflux/metrics"
 	"os"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -93,99 +98,278 @@ const packetVersion byte = 1
 var headerSize int = int(C.header_size)
 var metricSize int = int(C.record_size)
 
+// ListenOptions apply to all listeners
+type ListenOptions struct {
+	// server config for tls:// listeners
+	TLS *tls.Config
+	// allowed channel idents per client certificate CN
+	CertIdents map[string][]string
+	// owner, group and mode of unix sockets. -1 and 0 leave them unchanged
+	SocketOwner int
+	SocketGroup int
+	SocketMode  os.FileMode
+	// uids and gids allowed to connect to unix sockets. Empty allows all
+	AllowedUIDs []int
+	AllowedGIDs []int
+	// collectors send absolute counters instead of rates/s
+	AbsoluteCounters bool
+	// number of missed intervals, until a collector is reported down. 0 disables
+	MaxMissed int
+}
+
 type SocketConf struct {
-	socketPath string
+	network    string
+	address    string
+	options    *ListenOptions
 	listener   net.Listener
+	packetConn net.PacketConn
 	metricChan chan metricInfo
+	// accept loop and connection handlers
+	wg sync.WaitGroup
+	// open collector connections, closed with the listener
+	connLock sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
 }
 
-func New(socketPath string, metricChan chan metricInfo) *SocketConf {
+// New creates a listener for nfcapd metrics. network is "unix", "tcp", "udp" or "tls".
+// address is the socket path for unix, otherwise host:port.
+func New(network string, address string, options *ListenOptions, metricChan chan metricInfo) *SocketConf {
 	conf := new(SocketConf)
-	conf.socketPath = socketPath
+	conf.network = network
+	conf.address = address
+	conf.options = options
+	if conf.options == nil {
+		conf.options = &ListenOptions{SocketOwner: -1, SocketGroup: -1}
+	}
 	conf.metricChan = metricChan
+	conf.conns = make(map[net.Conn]bool)
 	return conf
 }
 
+// ParseListenAddress splits a listen address unix:///path, tcp://host:port,
+// udp://host:port or tls://host:port into network and address. A plain path
+// is a unix socket.
+func ParseListenAddress(listenAddress string) (string, string, error) {
+	i := strings.Index(listenAddress, "://")
+	if i < 0 {
+		return "unix", listenAddress, nil
+	}
+	network := listenAddress[:i]
+	address := listenAddress[i+3:]
+	switch network {
+	case "unix":
+	case "tcp", "udp", "tls":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported network: %s", network)
+	}
+	return network, address, nil
+}
+
+func (conf *SocketConf) String() string {
+	return conf.network + "://" + conf.address
+}
+
 func (conf *SocketConf) Open() error {
 
-	if err := os.RemoveAll(conf.socketPath); err != nil {
-		return err
-	}
-	listener, err := net.Listen("unix", conf.socketPath)
-	if err != nil {
-		return err
+	var err error
+	switch conf.network {
+	case "unix":
+		if err = os.RemoveAll(conf.address); err != nil {
+			return err
+		}
+		conf.listener, err = conf.listenUnix()
+	case "tcp":
+		conf.listener, err = net.Listen("tcp", conf.address)
+	case "udp":
+		conf.packetConn, err = net.ListenPacket("udp", conf.address)
+	case "tls":
+		if conf.options.TLS == nil {
+			return fmt.Errorf("tls listener requires certificates")
+		}
+		conf.listener, err = tls.Listen("tcp", conf.address, conf.options.TLS)
+	default:
+		err = fmt.Errorf("unsupported network: %s", conf.network)
 	}
-	conf.listener = listener
-	return nil
+	return err
 
 } // End of Open
 
 func (conf *SocketConf) Close() error {
 
-	err := conf.listener.Close()
-	os.Remove(conf.socketPath)
+	// terminate the handlers of persistent collector connections
+	conf.connLock.Lock()
+	conf.closed = true
+	for conn := range conf.conns {
+		conn.Close()
+	}
+	conf.connLock.Unlock()
+
+	var err error
+	if conf.listener != nil {
+		err = conf.listener.Close()
+	}
+	if conf.packetConn != nil {
+		err = conf.packetConn.Close()
+	}
+	if conf.network == "unix" {
+		os.Remove(conf.address)
+	}
 	return err
 
 } // End of Close
 
+// track an accepted connection. Returns false, if the listener is already closed
+func (conf *SocketConf) addConn(conn net.Conn) bool {
+	conf.connLock.Lock()
+	defer conf.connLock.Unlock()
+	if conf.closed {
+		return false
+	}
+	conf.conns[conn] = true
+	return true
+}
+
+// close a connection and stop tracking it
+func (conf *SocketConf) removeConn(conn net.Conn) {
+	conf.connLock.Lock()
+	delete(conf.conns, conn)
+	conf.connLock.Unlock()
+	conn.Close()
+}
+
+// isClosed reports, if the listener got closed
+func (conf *SocketConf) isClosed() bool {
+	conf.connLock.Lock()
+	defer conf.connLock.Unlock()
+	return conf.closed
+}
+
+// Wait until the listener and all its connection handlers are terminated
+func (conf *SocketConf) Wait() {
+	conf.wg.Wait()
+}
+
 func processStat(conf *SocketConf, conn net.Conn) {
 
-	defer conn.Close()
+	defer conf.removeConn(conn)
+
+	if conf.network == "unix" {
+		if err := conf.peerAllowed(conn); err != nil {
+			fmt.Printf("Reject connection on %s: %v\n", conf.address, err)
+			return
+		}
+	}
 
-	// storage for reading from socket.
+	// clients of tls listeners may only send metrics of their allowed idents
+	var allowedIdents []string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var err error
+		if allowedIdents, err = conf.tlsIdents(tlsConn); err != nil {
+			fmt.Printf("Reject TLS connection from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	// storage for reading from socket. The message size is a uint16
 	readBuf := make([]byte, 65536)
 
-	dataLen, err := conn.Read(readBuf)
-	if err != nil || dataLen == 0 {
-		fmt.Printf("Socket read error: %v\n", err)
+	// read any number of messages until the collector closes the connection.
+	// Messages may arrive split or back to back, so frame them by the header size
+	for {
+		if _, err := io.ReadFull(conn, readBuf[:headerSize]); err != nil {
+			if err != io.EOF && !conf.isClosed() {
+				fmt.Printf("Socket read error: %v\n", err)
+			}
+			return
+		}
+
+		// a corrupt header means the stream can not be resynchronised
+		if readBuf[0] != packetPrefix || readBuf[1] != packetVersion {
+			fmt.Printf("Message header error - prefix %d, version %d. Close connection\n", readBuf[0], readBuf[1])
+			metrics.ParseErrors.Add(1)
+			return
+		}
+		messageSize := int(binary.LittleEndian.Uint16(readBuf[2:4]))
+		if messageSize < headerSize {
+			fmt.Printf("Message size error - announced %d, header size %d. Close connection\n", messageSize, headerSize)
+			metrics.ParseErrors.Add(1)
+			return
+		}
+
+		if _, err := io.ReadFull(conn, readBuf[headerSize:messageSize]); err != nil {
+			fmt.Printf("Socket read error - incomplete message: %v\n", err)
+			return
+		}
+
+		decodeMessage(conf, readBuf[:messageSize], allowedIdents)
+	}
+
+} // end of processStat
+
+// decode a metric message and push all metrics into the metric channel.
+// If allowedIdents is not nil, metrics of any other ident are rejected.
+func decodeMessage(conf *SocketConf, readBuf []byte, allowedIdents []string) {
+
+	dataLen := len(readBuf)
+	if dataLen < headerSize {
+		fmt.Printf("Message size error - received %d, header size %d\n", dataLen, headerSize)
+		metrics.ParseErrors.Add(1)
 		return
 	}
 
 	// message prefix
 	if readBuf[0] != packetPrefix {
 		fmt.Printf("Message prefix error - got %d\n", readBuf[0])
+		metrics.ParseErrors.Add(1)
 		return
 	}
 
 	// version
 	if readBuf[1] != packetVersion {
 		fmt.Printf("Message prefix error - unknow version %d\n", readBuf[1])
+		metrics.ParseErrors.Add(1)
 		return
 	}
 
 	payloadSize := int(binary.LittleEndian.Uint16(readBuf[2:4]))
 	if dataLen < payloadSize {
 		fmt.Printf("Message size error - received %d, announced %d\n", dataLen, payloadSize)
+		metrics.ParseErrors.Add(1)
 		return
 	}
 
+	metrics.Messages.Add(1)
 	numMetrics := int(binary.LittleEndian.Uint16(readBuf[4:6]))
+	interval := int(binary.LittleEndian.Uint16(readBuf[6:8]))
 	timestamp := int(binary.LittleEndian.Uint64(readBuf[8:16]))
-
-	/*
-		interval	:= int(binary.LittleEndian.Uint64(readBuf[6:8]))
-		timestamp	:= int(binary.LittleEndian.Uint64(readBuf[8:16]))
-		uptime		:= int(binary.LittleEndian.Uint64(readBuf[16:24]))
-		fmt.Printf("Message size: %d, payload size: %d version: %d, numMetrics: %d\n",
-			dataLen, payloadSize, version, numMetrics);
-		fmt.Printf("Time(ms): %d, interval: %d, uptime: %d, ident: %s\n",
-			timestamp, interval, uptime, ident)
-	*/
+	uptime := binary.LittleEndian.Uint64(readBuf[16:24])
 
 	offset := headerSize
 	for num := 0; num < numMetrics; num++ {
 		availableSize := dataLen - offset
 		if availableSize < metricSize {
 			fmt.Printf("Message size error - left %d, expected %d\n", availableSize, metricSize)
+			metrics.ParseErrors.Add(1)
 			return
 		}
 		var s *C.metric_record_t = (*C.metric_record_t)(unsafe.Pointer(&readBuf[offset]))
 		metric := metricInfo{}
 
 		ident := C.GoString(&s.ident[0])
+		if allowedIdents != nil && !identAllowed(ident, allowedIdents) {
+			fmt.Printf("Reject metric for '%s' - ident not allowed for client\n", ident)
+			offset += metricSize
+			continue
+		}
 
 		metric.exporter = int(s.exporterID)
 		metric.timestamp = uint64(timestamp)
+		metric.interval = interval
+		metric.uptime = uptime
 		metric.ident = ident
 
 		metric.stat.NumflowsTcp = uint64(s.numflows_tcp)
@@ -208,21 +392,55 @@ func processStat(conf *SocketConf, conn net.Conn) {
 		offset += metricSize
 	}
 
-} // end of processStat
+} // end of decodeMessage
+
+// read datagrams, each containing one message
+func processPackets(conf *SocketConf) {
+
+	readBuf := make([]byte, 65536)
+	for {
+		dataLen, _, err := conf.packetConn.ReadFrom(readBuf)
+		if err != nil {
+			return
+		}
+		// each datagram counts like a connection with a single message
+		metrics.Connections.Add(1)
+		decodeMessage(conf, readBuf[:dataLen], nil)
+	}
+
+} // End of processPackets
 
 func (conf *SocketConf) Run(done chan bool) {
 
+	conf.wg.Add(1)
+	if conf.packetConn != nil {
+		go func() {
+			defer conf.wg.Done()
+			processPackets(conf)
+		}()
+		return
+	}
+
 	go func() {
+		defer conf.wg.Done()
 		for {
 			// Accept new connections from nfcapd collectors and
 			// dispatching them to goroutine processStat
 			conn, err := conf.listener.Accept()
 			if err == nil {
-				go processStat(conf, conn)
+				metrics.Connections.Add(1)
+				if !conf.addConn(conn) {
+					conn.Close()
+					continue
+				}
+				conf.wg.Add(1)
+				go func() {
+					defer conf.wg.Done()
+					processStat(conf, conn)
+				}()
 			} else {
 				select {
 				case <-done:
-					close(conf.metricChan)
 					return
 				default:
 					fmt.Printf("Accept() error: %v\n", err)
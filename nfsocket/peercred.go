@@ -0,0 +1,127 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package nfsocket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// LookupUID returns the uid of a user name or numeric uid
+func LookupUID(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// LookupGID returns the gid of a group name or numeric gid
+func LookupGID(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// ParseIDList converts a comma separated list of user or group names into ids
+func ParseIDList(list string, lookup func(string) (int, error)) ([]int, error) {
+	var ids []int
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		id, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// create the unix socket with the configured owner, group and mode
+func (conf *SocketConf) listenUnix() (net.Listener, error) {
+	options := conf.options
+	listener, err := net.Listen("unix", conf.address)
+	if err != nil {
+		return nil, err
+	}
+
+	// the mode is set after listen, as the umask is shared by all goroutines
+	if options.SocketMode != 0 {
+		if err := os.Chmod(conf.address, options.SocketMode.Perm()); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if options.SocketOwner >= 0 || options.SocketGroup >= 0 {
+		if err := os.Chown(conf.address, options.SocketOwner, options.SocketGroup); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// check the peer credentials of a unix socket connection against the allowed uids/gids
+func (conf *SocketConf) peerAllowed(conn net.Conn) error {
+	options := conf.options
+	if len(options.AllowedUIDs) == 0 && len(options.AllowedGIDs) == 0 {
+		return nil
+	}
+
+	uid, gid, err := peerCred(conn)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range options.AllowedUIDs {
+		if uid == allowed {
+			return nil
+		}
+	}
+	for _, allowed := range options.AllowedGIDs {
+		if gid == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer uid %d, gid %d not allowed", uid, gid)
+}
@@ -32,8 +32,9 @@ package nfsocket
 import (
 	"fmt"
 	"log"
-	"nfinflux/influx"
+	"nfinflux/metrics"
 	"nfinflux/nffile"
+	"nfinflux/output"
 	"os"
 	"os/signal"
 	"strconv"
@@ -42,55 +43,118 @@ import (
 )
 
 type metricInfo struct {
-	timestamp uint64
+	timestamp uint64 // msec
+	interval  int    // sec
+	uptime    uint64 // msec
 	ident     string
 	exporter  int
 	stat      nffile.StatRecord
 }
 
-// feed data to influx DB ever 60s
-func runFeeder(influxDB *influx.InfluxDBConf, bucket string, metricChan chan metricInfo) {
+// feed data to the outputs ever interval
+func runFeeder(writer output.Writer, metricChan chan metricInfo, options *ListenOptions) {
 
-	influxDB.StartWrite(bucket)
-	for metricRecord := range metricChan {
-		influxDB.InsertStat(time.UnixMilli(int64(metricRecord.timestamp)), metricRecord.ident, strconv.Itoa(metricRecord.exporter), metricRecord.stat)
-		fmt.Printf("Insert stat for '%s', at %v\n", metricRecord.ident, time.UnixMilli(int64(metricRecord.timestamp)))
+	if err := writer.StartWrite(); err != nil {
+		fmt.Printf("Start write: %v\n", err)
+	}
+	counters := make(counterTracker)
+
+	// liveness checks run in the feeder loop, so outputs are never written concurrently
+	var liveness *livenessTracker
+	var livenessTick <-chan time.Time
+	if options.MaxMissed > 0 {
+		liveness = newLivenessTracker(options.MaxMissed)
+		ticker := time.NewTicker(livenessCheck)
+		defer ticker.Stop()
+		livenessTick = ticker.C
+	}
+
+	for {
+		select {
+		case metricRecord, ok := <-metricChan:
+			if !ok {
+				if err := writer.EndWrite(); err != nil {
+					fmt.Printf("Insert stat record(s): %v\n", err)
+				}
+				fmt.Printf("Exit feeder\n")
+				return
+			}
+			if liveness != nil {
+				liveness.seen(&metricRecord, time.Now(), writer)
+			}
+			if !counters.update(&metricRecord, options.AbsoluteCounters) {
+				continue
+			}
+			// collectors send the per proto counters only
+			nffile.CalculateTotals(&metricRecord.stat)
+			writer.InsertStat(time.UnixMilli(int64(metricRecord.timestamp)), metricRecord.ident, strconv.Itoa(metricRecord.exporter), metricRecord.interval, metricRecord.stat)
+			fmt.Printf("Insert stat for '%s', at %v\n", metricRecord.ident, time.UnixMilli(int64(metricRecord.timestamp)))
+		case now := <-livenessTick:
+			liveness.check(now, writer)
+		}
 	}
-	influxDB.EndWrite()
-	fmt.Printf("Exit influx feeder\n")
 } // End of runFeeder
 
 // wait for signal TERM/INT(cntrl-C) and close done chan
-func SetupCloseHandler(socketHandler *SocketConf) chan bool {
+func SetupCloseHandler(socketHandlers []*SocketConf) chan bool {
 	done := make(chan bool)
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		fmt.Printf("nfinflux interrupted\n")
 		close(done)
-		socketHandler.Close()
+		for _, socketHandler := range socketHandlers {
+			socketHandler.Close()
+		}
 	}()
 	return done
 }
 
-// Listen on feeder socket and call feeder loop
-func SetupSocketFeeder(socketPath *string, bucket string, influxDB *influx.InfluxDBConf) {
+// Listen on all feeder sockets and call feeder loop. listenAddrs are
+// unix:///path, tcp://host:port, udp://host:port or tls://host:port addresses.
+func SetupSocketFeeder(listenAddrs []string, options *ListenOptions, writer output.Writer) {
 
 	// received data goes into the metric list
 	metricChan := make(chan metricInfo, 128)
-	socketHandler := New(*socketPath, metricChan)
-	if err := socketHandler.Open(); err != nil {
-		log.Fatal("Socket handler failed: ", err)
+	metrics.SetQueueDepth(func() int { return len(metricChan) })
+	if options == nil {
+		options = &ListenOptions{SocketOwner: -1, SocketGroup: -1}
 	}
 
-	fmt.Printf("nfinflux ready to accept connections\n")
+	var socketHandlers []*SocketConf
+	for _, listenAddr := range listenAddrs {
+		network, address, err := ParseListenAddress(listenAddr)
+		if err != nil {
+			log.Fatalf("Invalid listen address %s: %v", listenAddr, err)
+		}
+		socketHandler := New(network, address, options, metricChan)
+		if err := socketHandler.Open(); err != nil {
+			for _, h := range socketHandlers {
+				h.Close()
+			}
+			log.Fatal("Socket handler failed: ", err)
+		}
+		socketHandlers = append(socketHandlers, socketHandler)
+		fmt.Printf("nfinflux ready to accept metrics on %s\n", socketHandler)
+	}
 
 	// returns channel getting closed on signal
-	done := SetupCloseHandler(socketHandler)
+	done := SetupCloseHandler(socketHandlers)
 	// accepts connections until done closed
-	socketHandler.Run(done)
-	// metricChan gets closed by socketHandler in case of signal
-	runFeeder(influxDB, bucket, metricChan)
+	for _, socketHandler := range socketHandlers {
+		socketHandler.Run(done)
+	}
+
+	// close metricChan, after all listeners and their connections terminated
+	go func() {
+		<-done
+		for _, socketHandler := range socketHandlers {
+			socketHandler.Wait()
+		}
+		close(metricChan)
+	}()
+
+	runFeeder(writer, metricChan, options)
 	fmt.Printf("nfinflux terminated\n")
 }
@@ -0,0 +1,118 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package nfsocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// NewTLSConfig creates the server TLS config for tls:// listeners. Clients
+// must present a certificate signed by the CA in caFile.
+func NewTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %v", err)
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %v", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no valid certificates in CA file %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ParseCertIdents parses the mapping of client certificate CNs to allowed
+// channel idents: "cn1=ident1|ident2,cn2=ident3". Idents may be glob patterns.
+func ParseCertIdents(mapping string) (map[string][]string, error) {
+	certIdents := make(map[string][]string)
+	for _, entry := range strings.Split(mapping, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid CN ident mapping: %s", entry)
+		}
+		cn := entry[:i]
+		for _, ident := range strings.Split(entry[i+1:], "|") {
+			if _, err := path.Match(ident, ""); err != nil {
+				return nil, fmt.Errorf("invalid ident pattern %s: %v", ident, err)
+			}
+			certIdents[cn] = append(certIdents[cn], ident)
+		}
+	}
+	return certIdents, nil
+}
+
+// identAllowed checks ident against the allowed ident patterns of a client
+func identAllowed(ident string, allowedIdents []string) bool {
+	for _, pattern := range allowedIdents {
+		if ok, _ := path.Match(pattern, ident); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// verify the TLS handshake and return the allowed idents for the client certificate
+func (conf *SocketConf) tlsIdents(conn *tls.Conn) ([]string, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	cn := state.PeerCertificates[0].Subject.CommonName
+	allowedIdents, ok := conf.options.CertIdents[cn]
+	if !ok {
+		return nil, fmt.Errorf("client certificate CN '%s' not authorized", cn)
+	}
+	return allowedIdents, nil
+}
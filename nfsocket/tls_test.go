@@ -0,0 +1,276 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package nfsocket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// message builds a metric message with one record per ident
+func message(interval int, timestamp uint64, idents ...string) []byte {
+	size := headerSize + len(idents)*metricSize
+	buf := make([]byte, size)
+	buf[0] = packetPrefix
+	buf[1] = packetVersion
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(size))
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(len(idents)))
+	binary.LittleEndian.PutUint16(buf[6:8], uint16(interval))
+	binary.LittleEndian.PutUint64(buf[8:16], timestamp)
+	binary.LittleEndian.PutUint64(buf[16:24], 1000)
+	for i, ident := range idents {
+		record := buf[headerSize+i*metricSize:]
+		copy(record[:128], ident)
+		// exporterID and tcp flows
+		binary.LittleEndian.PutUint64(record[128:136], 1)
+		binary.LittleEndian.PutUint64(record[136:144], 10)
+	}
+	return buf
+}
+
+// testCA signs the server and client certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nfinflux test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue a certificate for cn and return it PEM encoded with its key
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientConfig returns the TLS config of a collector with a certificate for cn
+func (ca *testCA) clientConfig(t *testing.T, serverCA *testCA, cn string) *tls.Config {
+	certPEM, keyPEM := ca.issue(t, cn, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: roots}
+}
+
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	fileName := filepath.Join(dir, name)
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestParseCertIdents(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"edge1=live", map[string][]string{"edge1": {"live"}}, false},
+		{"edge1=live|site-*, edge2=edge2", map[string][]string{"edge1": {"live", "site-*"}, "edge2": {"edge2"}}, false},
+		{"", map[string][]string{}, false},
+		{"edge1", nil, true},
+		{"=live", nil, true},
+		{"edge1=site-[", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseCertIdents(test.mapping)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseCertIdents(%q) error = %v, want error %v", test.mapping, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseCertIdents(%q) = %v, want %v", test.mapping, got, test.want)
+		}
+	}
+}
+
+func TestIdentAllowed(t *testing.T) {
+	tests := []struct {
+		ident   string
+		allowed []string
+		want    bool
+	}{
+		{"live", []string{"live"}, true},
+		{"live2", []string{"live"}, false},
+		{"site-a", []string{"live", "site-*"}, true},
+		{"site-", []string{"site-*"}, true},
+		{"edge1", []string{"edge?"}, true},
+		{"edge12", []string{"edge?"}, false},
+		{"site/a", []string{"site*"}, false},
+		{"live", []string{}, false},
+	}
+	for _, test := range tests {
+		if got := identAllowed(test.ident, test.allowed); got != test.want {
+			t.Errorf("identAllowed(%q, %v) = %v, want %v", test.ident, test.allowed, got, test.want)
+		}
+	}
+}
+
+func TestTLSIdents(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "nfinflux", x509.ExtKeyUsageServerAuth)
+	tlsConfig, err := NewTLSConfig(writeFile(t, dir, "server.pem", certPEM),
+		writeFile(t, dir, "server.key", keyPEM), writeFile(t, dir, "ca.pem", ca.pem))
+	if err != nil {
+		t.Fatalf("NewTLSConfig: %v", err)
+	}
+	certIdents, err := ParseCertIdents("edge1=live|site-*,edge2=edge2")
+	if err != nil {
+		t.Fatalf("ParseCertIdents: %v", err)
+	}
+
+	metricChan := make(chan metricInfo, 16)
+	conf := New("tls", "127.0.0.1:0", &ListenOptions{TLS: tlsConfig, CertIdents: certIdents, SocketOwner: -1, SocketGroup: -1}, metricChan)
+	if err := conf.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	done := make(chan bool)
+	conf.Run(done)
+	t.Cleanup(func() {
+		close(done)
+		conf.Close()
+		conf.Wait()
+	})
+	address := conf.listener.Addr().String()
+
+	foreignCA := newTestCA(t)
+	tests := []struct {
+		name   string
+		config *tls.Config
+		idents []string
+		want   []string
+		// the server drops the connection
+		rejected bool
+	}{
+		{"allowed idents", ca.clientConfig(t, ca, "edge1"), []string{"edge2", "live", "site-a", "site-b", "other"}, []string{"live", "site-a", "site-b"}, false},
+		{"foreign ident", ca.clientConfig(t, ca, "edge2"), []string{"live"}, nil, false},
+		{"unknown CN", ca.clientConfig(t, ca, "edge3"), []string{"live"}, nil, true},
+		{"foreign CA", foreignCA.clientConfig(t, ca, "edge1"), []string{"live"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", address, test.config)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			conn.Write(message(60, uint64(time.Now().UnixMilli()), test.idents...))
+			if test.rejected {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadAll(conn); err != nil && os.IsTimeout(err) {
+					t.Errorf("rejected connection not closed by the server")
+				}
+			}
+			conn.Close()
+
+			var got []string
+			for range test.want {
+				select {
+				case metric := <-metricChan:
+					got = append(got, metric.ident)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("got metrics %v, want %v", got, test.want)
+				}
+			}
+			// no further metric, e.g. of a foreign ident, is queued
+			select {
+			case metric := <-metricChan:
+				t.Errorf("unexpected metric for %q", metric.ident)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got metrics %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// env variables, which set the default of an option
+var envOptions = map[string]string{
+	"host":     "INFLUXDB_URL",
+	"token":    "INFLUXDB_TOKEN",
+	"user":     "INFLUXDB_USER",
+	"password": "INFLUXDB_PASSWORD",
+}
+
+// options holds the values of all command line flags. The options of an
+// output in the config file are applied to a copy of the options.
+type options struct {
+	config          string
+	influxHost      string
+	org             string
+	bucket          string
+	token           string
+	socketPath      string
+	listenAddrs     string
+	watchDirs       string
+	tlsCert         string
+	tlsKey          string
+	tlsCA           string
+	tlsIdents       string
+	socketOwner     string
+	socketGroup     string
+	socketPerm      string
+	allowUIDs       string
+	allowGIDs       string
+	counters        string
+	maxMissed       int
+	createBucket    bool
+	cleanBucket     bool
+	twin            int
+	v1              bool
+	database        string
+	rp              string
+	user            string
+	password        string
+	derived         bool
+	schemaLayout    string
+	measurement     string
+	wideMeasurement string
+	fieldNames      string
+	staticTags      string
+	outputs         string
+	routes          string
+	graphiteAddr    string
+	graphitePrefix  string
+	graphiteReplace string
+	otlpEndpoint    string
+	otlpProtocol    string
+	otlpSum         bool
+	pgDSN           string
+	pgTable         string
+	pgHypertable    bool
+	sqliteFile      string
+	sqliteRetention time.Duration
+	parquetDir      string
+	parquetRoll     time.Duration
+	kafkaBrokers    string
+	kafkaTopic      string
+	kafkaFormat     string
+	kafkaCompress   string
+	kafkaAcks       int
+	mqttBroker      string
+	mqttTopic       string
+	mqttQos         int
+	mqttRetain      bool
+	mqttUser        string
+	mqttPassword    string
+	statsdAddr      string
+	statsdPrefix    string
+	statsdTags      bool
+	statsdTimestamp bool
+	alertRules      string
+	alertWebhook    string
+	anomalyDetect   bool
+	anomalySigma    float64
+	anomalyAlpha    float64
+	anomalyState    string
+	seasonal        bool
+	seasonalScore   float64
+	statsListen     string
+	statsInterval   time.Duration
+}
+
+// default options, updated by the env variables, if set
+func newOptions() *options {
+	opts := &options{
+		influxHost:      "http://127.0.0.1:8086",
+		org:             "Netflow",
+		bucket:          "life",
+		counters:        "rate",
+		maxMissed:       3,
+		twin:            300,
+		schemaLayout:    "proto",
+		measurement:     "stat",
+		wideMeasurement: "stat_wide",
+		outputs:         "influx",
+		graphiteAddr:    "tcp://127.0.0.1:2003",
+		graphitePrefix:  "nfinflux",
+		graphiteReplace: "_",
+		otlpEndpoint:    "http://127.0.0.1:4317",
+		otlpProtocol:    "grpc",
+		pgDSN:           "postgres://localhost/nfinflux?sslmode=disable",
+		pgTable:         "nfinflux_stat",
+		sqliteFile:      "nfinflux.db",
+		sqliteRetention: 30 * 24 * time.Hour,
+		parquetDir:      "parquet",
+		parquetRoll:     time.Hour,
+		kafkaBrokers:    "127.0.0.1:9092",
+		kafkaTopic:      "nfinflux",
+		kafkaFormat:     "json",
+		kafkaCompress:   "snappy",
+		kafkaAcks:       -1,
+		mqttBroker:      "tcp://127.0.0.1:1883",
+		mqttTopic:       "nfinflux",
+		mqttRetain:      true,
+		statsdAddr:      "udp://127.0.0.1:8125",
+		statsdPrefix:    "nfinflux",
+		statsdTags:      true,
+		anomalySigma:    3,
+		anomalyAlpha:    0.05,
+		seasonalScore:   5,
+		statsInterval:   time.Minute,
+	}
+
+	// get env variables, if set
+	envValues := map[string]*string{
+		"host":     &opts.influxHost,
+		"token":    &opts.token,
+		"user":     &opts.user,
+		"password": &opts.password,
+	}
+	for name, env := range envOptions {
+		if value := os.Getenv(env); len(value) > 0 {
+			*envValues[name] = value
+		}
+	}
+	return opts
+} // End of newOptions
+
+// register all options as flags of flagSet. The current values are the defaults.
+func (opts *options) register(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&opts.config, "config", opts.config, "YAML config file with options, inputs, outputs and routes")
+	flagSet.StringVar(&opts.influxHost, "host", opts.influxHost, "Address to send metric data")
+	flagSet.StringVar(&opts.org, "org", opts.org, "influxDB organisation name")
+	flagSet.StringVar(&opts.bucket, "bucket", opts.bucket, "influxDB bucket name")
+	flagSet.StringVar(&opts.token, "token", opts.token, "influxDB token")
+	flagSet.StringVar(&opts.socketPath, "socket", opts.socketPath, "Path for nfcapd collectors to connect")
+	flagSet.StringVar(&opts.listenAddrs, "listen", opts.listenAddrs, "comma separated list of tcp://host:port, udp://host:port, tls://host:port or unix:///path to accept metrics")
+	flagSet.StringVar(&opts.watchDirs, "watch", opts.watchDirs, "comma separated list of directories to watch for new flow files")
+	flagSet.StringVar(&opts.tlsCert, "tls-cert", opts.tlsCert, "server certificate file for tls:// listeners")
+	flagSet.StringVar(&opts.tlsKey, "tls-key", opts.tlsKey, "server key file for tls:// listeners")
+	flagSet.StringVar(&opts.tlsCA, "tls-ca", opts.tlsCA, "CA file to verify client certificates of tls:// listeners")
+	flagSet.StringVar(&opts.tlsIdents, "tls-idents", opts.tlsIdents, "allowed idents per client certificate CN: cn1=ident1|ident2,cn2=ident3")
+	flagSet.StringVar(&opts.socketOwner, "socket-owner", opts.socketOwner, "owner (user name or uid) of unix sockets")
+	flagSet.StringVar(&opts.socketGroup, "socket-group", opts.socketGroup, "group (group name or gid) of unix sockets")
+	flagSet.StringVar(&opts.socketPerm, "socket-mode", opts.socketPerm, "octal file mode of unix sockets e.g. 0660")
+	flagSet.StringVar(&opts.allowUIDs, "allow-uid", opts.allowUIDs, "comma separated list of users (name or uid) allowed to connect to unix sockets")
+	flagSet.StringVar(&opts.allowGIDs, "allow-gid", opts.allowGIDs, "comma separated list of groups (name or gid) allowed to connect to unix sockets")
+	flagSet.StringVar(&opts.counters, "counters", opts.counters, "socket metric counters sent by the collectors: rate or absolute")
+	flagSet.IntVar(&opts.maxMissed, "missed", opts.maxMissed, "report a collector down after missing this number of intervals, 0 disables")
+	flagSet.BoolVar(&opts.createBucket, "create", opts.createBucket, "create bucket, if it does not exist")
+	flagSet.BoolVar(&opts.cleanBucket, "delete", opts.cleanBucket, "delete existing bucket first")
+	flagSet.IntVar(&opts.twin, "twin", opts.twin, "time interval in seconds of flow file")
+	flagSet.BoolVar(&opts.v1, "v1", opts.v1, "use InfluxDB 1.x compatible write API")
+	flagSet.StringVar(&opts.database, "db", opts.database, "influxDB 1.x database name")
+	flagSet.StringVar(&opts.rp, "rp", opts.rp, "influxDB 1.x retention policy")
+	flagSet.StringVar(&opts.user, "user", opts.user, "influxDB 1.x user name")
+	flagSet.StringVar(&opts.password, "password", opts.password, "influxDB 1.x password")
+	flagSet.BoolVar(&opts.derived, "derived", opts.derived, "add average packet size, average flow size and proto share fields to influxDB points")
+	flagSet.StringVar(&opts.schemaLayout, "schema", opts.schemaLayout, "influxDB point layout: proto, wide or both")
+	flagSet.StringVar(&opts.measurement, "measurement", opts.measurement, "influxDB measurement of per proto points")
+	flagSet.StringVar(&opts.wideMeasurement, "wide-measurement", opts.wideMeasurement, "influxDB measurement of wide points")
+	flagSet.StringVar(&opts.fieldNames, "field-names", opts.fieldNames, "influxDB field names: flows=fps,packets=pps,bytes=bps")
+	flagSet.StringVar(&opts.staticTags, "tags", opts.staticTags, "static tags added to all influxDB points: site=fra1,env=prod")
+	flagSet.StringVar(&opts.outputs, "output", opts.outputs, "comma separated list of outputs: "+strings.Join(outputNames(), ", "))
+	flagSet.StringVar(&opts.routes, "route", opts.routes, "comma separated list of influxDB routes channel=bucket[@org][:token], channel is a glob or re:regex e.g. cust1*=cust1")
+	flagSet.StringVar(&opts.graphiteAddr, "graphite", opts.graphiteAddr, "Graphite server address tcp://host:port or udp://host:port")
+	flagSet.StringVar(&opts.graphitePrefix, "graphite-prefix", opts.graphitePrefix, "Graphite metric path prefix")
+	flagSet.StringVar(&opts.graphiteReplace, "graphite-replace", opts.graphiteReplace, "replacement for invalid characters in Graphite path nodes")
+	flagSet.StringVar(&opts.otlpEndpoint, "otlp", opts.otlpEndpoint, "OTLP receiver endpoint URL")
+	flagSet.StringVar(&opts.otlpProtocol, "otlp-protocol", opts.otlpProtocol, "OTLP protocol: grpc or http")
+	flagSet.BoolVar(&opts.otlpSum, "otlp-sum", opts.otlpSum, "export OTLP monotonic sums instead of gauges")
+	flagSet.StringVar(&opts.pgDSN, "pg", opts.pgDSN, "PostgreSQL connection string")
+	flagSet.StringVar(&opts.pgTable, "pg-table", opts.pgTable, "PostgreSQL stat table [schema.]table")
+	flagSet.BoolVar(&opts.pgHypertable, "pg-hypertable", opts.pgHypertable, "create the stat table as TimescaleDB hypertable")
+	flagSet.StringVar(&opts.sqliteFile, "sqlite", opts.sqliteFile, "SQLite database file")
+	flagSet.DurationVar(&opts.sqliteRetention, "sqlite-retention", opts.sqliteRetention, "SQLite retention time, 0 keeps all records")
+	flagSet.StringVar(&opts.parquetDir, "parquet", opts.parquetDir, "Parquet output directory")
+	flagSet.DurationVar(&opts.parquetRoll, "parquet-roll", opts.parquetRoll, "max time a Parquet file is kept open")
+	flagSet.StringVar(&opts.kafkaBrokers, "kafka", opts.kafkaBrokers, "comma separated list of Kafka brokers")
+	flagSet.StringVar(&opts.kafkaTopic, "kafka-topic", opts.kafkaTopic, "Kafka topic")
+	flagSet.StringVar(&opts.kafkaFormat, "kafka-format", opts.kafkaFormat, "Kafka message format: json or avro")
+	flagSet.StringVar(&opts.kafkaCompress, "kafka-compression", opts.kafkaCompress, "Kafka compression: none, gzip, snappy, lz4 or zstd")
+	flagSet.IntVar(&opts.kafkaAcks, "kafka-acks", opts.kafkaAcks, "Kafka required acks: 0 none, 1 leader, -1 all")
+	flagSet.StringVar(&opts.mqttBroker, "mqtt", opts.mqttBroker, "MQTT broker URL")
+	flagSet.StringVar(&opts.mqttTopic, "mqtt-topic", opts.mqttTopic, "MQTT topic prefix")
+	flagSet.IntVar(&opts.mqttQos, "mqtt-qos", opts.mqttQos, "MQTT QoS level 0, 1 or 2")
+	flagSet.BoolVar(&opts.mqttRetain, "mqtt-retain", opts.mqttRetain, "publish MQTT messages as retained last values")
+	flagSet.StringVar(&opts.mqttUser, "mqtt-user", opts.mqttUser, "MQTT user name")
+	flagSet.StringVar(&opts.mqttPassword, "mqtt-password", opts.mqttPassword, "MQTT password")
+	flagSet.StringVar(&opts.statsdAddr, "statsd", opts.statsdAddr, "StatsD server address udp://host:port or unixgram:///path")
+	flagSet.StringVar(&opts.statsdPrefix, "statsd-prefix", opts.statsdPrefix, "StatsD metric name prefix")
+	flagSet.BoolVar(&opts.statsdTags, "statsd-tags", opts.statsdTags, "use DogStatsD tags for channel, exporter and proto")
+	flagSet.BoolVar(&opts.statsdTimestamp, "statsd-timestamp", opts.statsdTimestamp, "send the record time with each DogStatsD gauge")
+	flagSet.StringVar(&opts.alertRules, "alert", opts.alertRules, "comma separated list of alert rules e.g. \"edge*:udp.pps > 500k for 3\"")
+	flagSet.StringVar(&opts.alertWebhook, "alert-webhook", opts.alertWebhook, "webhook URL to post alert events")
+	flagSet.BoolVar(&opts.anomalyDetect, "anomaly", opts.anomalyDetect, "detect pps and fps anomalies against EWMA baselines")
+	flagSet.Float64Var(&opts.anomalySigma, "anomaly-sigma", opts.anomalySigma, "number of standard deviations above the baseline to report an anomaly")
+	flagSet.Float64Var(&opts.anomalyAlpha, "anomaly-alpha", opts.anomalyAlpha, "EWMA smoothing factor of the anomaly baselines")
+	flagSet.StringVar(&opts.anomalyState, "anomaly-state", opts.anomalyState, "file to save the anomaly baselines across restarts")
+	flagSet.BoolVar(&opts.seasonal, "seasonal", opts.seasonal, "score imported records against day of week and hour of day baselines")
+	flagSet.Float64Var(&opts.seasonalScore, "seasonal-score", opts.seasonalScore, "min deviation score of imported records to list as incident")
+	flagSet.StringVar(&opts.statsListen, "stats-listen", opts.statsListen, "host:port to serve the internal counters on http://host:port/debug/vars")
+	flagSet.DurationVar(&opts.statsInterval, "stats-interval", opts.statsInterval, "interval to write the internal counters as nfinflux_internal points, 0 disables")
+} // End of register
+
+// applyFile sets the options of the config file, which are neither set on
+// the command line nor by an env variable
+func applyFile(flagSet *flag.FlagSet, values map[string]string) error {
+	isSet := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) {
+		isSet[f.Name] = true
+	})
+	for name, value := range values {
+		if name == "config" {
+			return fmt.Errorf("option config not allowed in config file")
+		}
+		if flagSet.Lookup(name) == nil {
+			return fmt.Errorf("unknown option: %s", name)
+		}
+		if isSet[name] || (len(envOptions[name]) > 0 && len(os.Getenv(envOptions[name])) > 0) {
+			continue
+		}
+		if err := flagSet.Set(name, value); err != nil {
+			return fmt.Errorf("option %s: %v", name, err)
+		}
+	}
+	return nil
+} // End of applyFile
+
+// outputOptions returns a copy of opts with the options of an output applied
+func (opts *options) outputOptions(name string, values map[string]string) (*options, error) {
+	outputOpts := *opts
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	outputOpts.register(flagSet)
+	for key, value := range values {
+		if key == "config" || flagSet.Lookup(key) == nil {
+			return nil, fmt.Errorf("output %s: unknown option: %s", name, key)
+		}
+		if err := flagSet.Set(key, value); err != nil {
+			return nil, fmt.Errorf("output %s: option %s: %v", name, key, err)
+		}
+	}
+	return &outputOpts, nil
+} // End of outputOptions
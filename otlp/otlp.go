@@ -0,0 +1,297 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * otlp exports the stat records as OpenTelemetry metrics to an OTLP receiver
+ * such as the OpenTelemetry Collector. Each channel ident becomes its own
+ * resource, exporter and proto are data point attributes.
+ */
+
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// number of buffered data points, before they are exported
+const batchSize = 3000
+
+// max time data points are buffered
+const flushInterval = 5 * time.Second
+
+// common interface of the grpc and http exporter
+type exporter interface {
+	Export(ctx context.Context, rm *metricdata.ResourceMetrics) error
+	Shutdown(ctx context.Context) error
+}
+
+type protoStat struct {
+	proto   string
+	flows   uint64
+	packets uint64
+	bytes   uint64
+}
+
+// cumulative state of a monotonic sum series
+type sumState struct {
+	start time.Time
+	last  time.Time
+	value [3]int64
+}
+
+type OtlpConf struct {
+	endpoint  string
+	monotonic bool
+	exporter  exporter
+	lock      sync.Mutex
+	// buffered data points per ident
+	gauges    map[string][3][]metricdata.DataPoint[int64]
+	numPoints int
+	sums      map[string]*sumState
+	errList   []error
+	// signals the flush goroutine a full batch
+	flush chan bool
+	done  chan bool
+	wg    sync.WaitGroup
+}
+
+var metricNames = [3]string{"nfdump.flows", "nfdump.packets", "nfdump.bytes"}
+var metricDesc = [3]string{"flows per second", "packets per second", "bytes per second"}
+var metricUnit = [3]string{"{flow}/s", "{packet}/s", "By/s"}
+var sumDesc = [3]string{"number of flows", "number of packets", "number of bytes"}
+var sumUnit = [3]string{"{flow}", "{packet}", "By"}
+
+// New creates an OTLP output. protocol is "grpc" or "http", endpoint the URL of the
+// receiver e.g. http://127.0.0.1:4317 for grpc or http://127.0.0.1:4318/v1/metrics for http.
+// If monotonic is set, the rates are accumulated to monotonic sums, otherwise gauges are exported.
+func New(protocol string, endpoint string, monotonic bool) (*OtlpConf, error) {
+	ctx := context.Background()
+
+	otlpConf := new(OtlpConf)
+	otlpConf.endpoint = endpoint
+	otlpConf.monotonic = monotonic
+	otlpConf.gauges = make(map[string][3][]metricdata.DataPoint[int64])
+	otlpConf.sums = make(map[string]*sumState)
+	otlpConf.flush = make(chan bool, 1)
+
+	var err error
+	switch protocol {
+	case "grpc":
+		otlpConf.exporter, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(endpoint))
+	case "http":
+		otlpConf.exporter, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint))
+	default:
+		err = fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("otlp: %v", err)
+	}
+	return otlpConf, nil
+} // End of New
+
+func (otlpConf *OtlpConf) StartWrite() error {
+	otlpConf.done = make(chan bool)
+	otlpConf.wg.Add(1)
+	go func() {
+		defer otlpConf.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				otlpConf.Flush()
+			case <-otlpConf.flush:
+				otlpConf.Flush()
+			case <-otlpConf.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (otlpConf *OtlpConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	protoStats := []protoStat{
+		{"tcp", statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp},
+		{"udp", statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp},
+		{"icmp", statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp},
+		{"other", statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther},
+	}
+
+	otlpConf.lock.Lock()
+	dataPoints := otlpConf.gauges[ident]
+	for _, stat := range protoStats {
+		attrs := attribute.NewSet(
+			attribute.String("exporter", exporterID),
+			attribute.String("proto", stat.proto),
+		)
+		values := [3]int64{int64(stat.flows), int64(stat.packets), int64(stat.bytes)}
+		var start time.Time
+		if interval > 0 {
+			start = when.Add(-time.Duration(interval) * time.Second)
+		}
+		if otlpConf.monotonic {
+			start, values = otlpConf.accumulate(ident+"/"+attrs.Encoded(attribute.DefaultEncoder()), when, start, values)
+		}
+		for i := range values {
+			dataPoints[i] = append(dataPoints[i], metricdata.DataPoint[int64]{
+				Attributes: attrs,
+				StartTime:  start,
+				Time:       when,
+				Value:      values[i],
+			})
+		}
+		otlpConf.numPoints += len(values)
+	}
+	otlpConf.gauges[ident] = dataPoints
+	numPoints := otlpConf.numPoints
+	otlpConf.lock.Unlock()
+
+	// export in the flush goroutine, the caller holds the writer lock
+	if numPoints >= batchSize {
+		select {
+		case otlpConf.flush <- true:
+		default:
+		}
+	}
+}
+
+// accumulate the rates of a series into cumulative counters, using the time
+// between two records as interval. The first record counts from start, if
+// its interval is known.
+func (otlpConf *OtlpConf) accumulate(key string, when time.Time, start time.Time, rates [3]int64) (time.Time, [3]int64) {
+	state, ok := otlpConf.sums[key]
+	if !ok {
+		if start.IsZero() {
+			start = when
+		}
+		state = &sumState{start: start, last: start}
+		otlpConf.sums[key] = state
+	}
+	if interval := int64(when.Sub(state.last) / time.Second); interval > 0 {
+		for i := range rates {
+			state.value[i] += rates[i] * interval
+		}
+		state.last = when
+	}
+	return state.start, state.value
+}
+
+// build the resource metrics of an ident
+func (otlpConf *OtlpConf) resourceMetrics(ident string, dataPoints [3][]metricdata.DataPoint[int64]) *metricdata.ResourceMetrics {
+	metrics := make([]metricdata.Metrics, 0, len(metricNames))
+	for i := range metricNames {
+		m := metricdata.Metrics{Name: metricNames[i]}
+		if otlpConf.monotonic {
+			m.Description = sumDesc[i]
+			m.Unit = sumUnit[i]
+			m.Data = metricdata.Sum[int64]{
+				DataPoints:  dataPoints[i],
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			}
+		} else {
+			m.Description = metricDesc[i]
+			m.Unit = metricUnit[i]
+			m.Data = metricdata.Gauge[int64]{DataPoints: dataPoints[i]}
+		}
+		metrics = append(metrics, m)
+	}
+
+	return &metricdata.ResourceMetrics{
+		Resource: resource.NewSchemaless(
+			attribute.String("service.name", "nfinflux"),
+			attribute.String("nfdump.channel", ident),
+		),
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "nfinflux"},
+			Metrics: metrics,
+		}},
+	}
+}
+
+// Flush exports all buffered data points
+func (otlpConf *OtlpConf) Flush() {
+	otlpConf.lock.Lock()
+	gauges := otlpConf.gauges
+	otlpConf.gauges = make(map[string][3][]metricdata.DataPoint[int64])
+	otlpConf.numPoints = 0
+	otlpConf.lock.Unlock()
+
+	for ident, dataPoints := range gauges {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := otlpConf.exporter.Export(ctx, otlpConf.resourceMetrics(ident, dataPoints))
+		cancel()
+		numPoints := int64(len(dataPoints[0]) + len(dataPoints[1]) + len(dataPoints[2]))
+		if err != nil {
+			fmt.Printf("otlp export error: %v\n", err)
+			metrics.WriteErrors.Add(1)
+			metrics.PointsFailed.Add(numPoints)
+			otlpConf.lock.Lock()
+			otlpConf.errList = append(otlpConf.errList, err)
+			otlpConf.lock.Unlock()
+			continue
+		}
+		metrics.PointsWritten.Add(numPoints)
+	}
+}
+
+func (otlpConf *OtlpConf) EndWrite() error {
+	if otlpConf.done != nil {
+		close(otlpConf.done)
+		otlpConf.wg.Wait()
+		otlpConf.done = nil
+	}
+	otlpConf.Flush()
+
+	otlpConf.lock.Lock()
+	defer otlpConf.lock.Unlock()
+	if otlpConf.errList != nil {
+		return fmt.Errorf("otlp failed exports: %d", len(otlpConf.errList))
+	}
+	return nil
+}
+
+func (otlpConf *OtlpConf) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return otlpConf.exporter.Shutdown(ctx)
+}
@@ -0,0 +1,221 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package otlp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nfinflux/nffile"
+	"testing"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// start a local OTLP/HTTP receiver, which answers with status
+func newReceiver(t *testing.T, status int) (*httptest.Server, chan *colmetricpb.ExportMetricsServiceRequest) {
+	requests := make(chan *colmetricpb.ExportMetricsServiceRequest, 64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		request := new(colmetricpb.ExportMetricsServiceRequest)
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests <- request
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newOtlp(t *testing.T, server *httptest.Server, monotonic bool) *OtlpConf {
+	otlpConf, err := New("http", server.URL+"/v1/metrics", monotonic)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { otlpConf.Close() })
+	return otlpConf
+}
+
+// channel ident of the resource
+func channel(resourceMetrics *metricpb.ResourceMetrics) string {
+	for _, attr := range resourceMetrics.GetResource().GetAttributes() {
+		if attr.GetKey() == "nfdump.channel" {
+			return attr.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+// data points of a metric by proto
+func dataPoints(resourceMetrics *metricpb.ResourceMetrics, name string) map[string]*metricpb.NumberDataPoint {
+	points := make(map[string]*metricpb.NumberDataPoint)
+	for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+		for _, m := range scopeMetrics.GetMetrics() {
+			if m.GetName() != name {
+				continue
+			}
+			list := m.GetGauge().GetDataPoints()
+			if m.GetSum() != nil {
+				list = m.GetSum().GetDataPoints()
+			}
+			for _, point := range list {
+				for _, attr := range point.GetAttributes() {
+					if attr.GetKey() == "proto" {
+						points[attr.GetValue().GetStringValue()] = point
+					}
+				}
+			}
+		}
+	}
+	return points
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"exported", http.StatusOK, false},
+		{"rejected", http.StatusBadRequest, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newReceiver(t, test.status)
+			otlpConf := newOtlp(t, server, false)
+
+			when := time.Unix(1700000000, 0)
+			if err := otlpConf.StartWrite(); err != nil {
+				t.Fatalf("StartWrite: %v", err)
+			}
+			otlpConf.InsertStat(when, "live", "1", 300, nffile.StatRecord{NumflowsTcp: 10, NumflowsUdp: 5, NumbytesTcp: 2000})
+			err := otlpConf.EndWrite()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("EndWrite error = %v, want error %v", err, test.wantErr)
+			}
+
+			request := <-requests
+			if len(request.GetResourceMetrics()) != 1 {
+				t.Fatalf("got %d resources, want 1", len(request.GetResourceMetrics()))
+			}
+			resourceMetrics := request.GetResourceMetrics()[0]
+			if got := channel(resourceMetrics); got != "live" {
+				t.Errorf("channel = %q, want live", got)
+			}
+			flows := dataPoints(resourceMetrics, "nfdump.flows")
+			if len(flows) != 4 {
+				t.Fatalf("got %d flow data points, want 4", len(flows))
+			}
+			if got := flows["tcp"].GetAsInt(); got != 10 {
+				t.Errorf("tcp flows = %d, want 10", got)
+			}
+			if got := flows["udp"].GetAsInt(); got != 5 {
+				t.Errorf("udp flows = %d, want 5", got)
+			}
+			if got, want := flows["tcp"].GetStartTimeUnixNano(), uint64(when.Add(-300*time.Second).UnixNano()); got != want {
+				t.Errorf("start time = %d, want %d", got, want)
+			}
+			if got := dataPoints(resourceMetrics, "nfdump.bytes")["tcp"].GetAsInt(); got != 2000 {
+				t.Errorf("tcp bytes = %d, want 2000", got)
+			}
+		})
+	}
+}
+
+func TestExportMonotonic(t *testing.T) {
+	server, requests := newReceiver(t, http.StatusOK)
+	otlpConf := newOtlp(t, server, true)
+
+	when := time.Unix(1700000000, 0)
+	otlpConf.InsertStat(when, "live", "1", 60, nffile.StatRecord{NumflowsTcp: 10})
+	otlpConf.InsertStat(when.Add(60*time.Second), "live", "1", 60, nffile.StatRecord{NumflowsTcp: 20})
+	if err := otlpConf.EndWrite(); err != nil {
+		t.Fatalf("EndWrite: %v", err)
+	}
+
+	request := <-requests
+	var values []int64
+	for _, scopeMetrics := range request.GetResourceMetrics()[0].GetScopeMetrics() {
+		for _, m := range scopeMetrics.GetMetrics() {
+			if m.GetName() != "nfdump.flows" {
+				continue
+			}
+			if !m.GetSum().GetIsMonotonic() {
+				t.Errorf("nfdump.flows is not a monotonic sum")
+			}
+			for _, point := range m.GetSum().GetDataPoints() {
+				for _, attr := range point.GetAttributes() {
+					if attr.GetKey() == "proto" && attr.GetValue().GetStringValue() == "tcp" {
+						values = append(values, point.GetAsInt())
+					}
+				}
+			}
+		}
+	}
+	// 10 flows/s over 60s, then 20 flows/s over another 60s
+	if len(values) != 2 || values[0] != 600 || values[1] != 1800 {
+		t.Errorf("tcp flow sums = %v, want [600 1800]", values)
+	}
+}
+
+// a full batch is exported in the background, before EndWrite
+func TestBatchExport(t *testing.T) {
+	server, requests := newReceiver(t, http.StatusOK)
+	otlpConf := newOtlp(t, server, false)
+
+	if err := otlpConf.StartWrite(); err != nil {
+		t.Fatalf("StartWrite: %v", err)
+	}
+	when := time.Unix(1700000000, 0)
+	// 4 protos with 3 metrics each per record
+	for i := 0; i < batchSize/12; i++ {
+		otlpConf.InsertStat(when.Add(time.Duration(i)*time.Second), "live", "1", 1, nffile.StatRecord{NumflowsTcp: 1})
+	}
+
+	select {
+	case request := <-requests:
+		if got := len(dataPoints(request.GetResourceMetrics()[0], "nfdump.flows")); got != 4 {
+			t.Errorf("got %d flow protos, want 4", got)
+		}
+	case <-time.After(flushInterval / 2):
+		t.Errorf("full batch not exported")
+	}
+	if err := otlpConf.EndWrite(); err != nil {
+		t.Errorf("EndWrite: %v", err)
+	}
+}
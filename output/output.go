@@ -0,0 +1,167 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * output defines the common interface of all metric outputs, nfinflux feeds
+ * stat records into. Multiple outputs may be combined with MultiWriter.
+ */
+
+package output
+
+import (
+	"fmt"
+	"nfinflux/nffile"
+	"time"
+)
+
+// Writer is implemented by any output backend
+type Writer interface {
+	// StartWrite prepares the output for writing stat records
+	StartWrite() error
+	// InsertStat writes the stat record of a channel and exporter. The record
+	// contains the rates/s within interval seconds, 0 if the interval is unknown
+	InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord)
+	// EndWrite flushes all pending records and reports failed writes
+	EndWrite() error
+	// Close releases all resources of the output
+	Close() error
+}
+
+// StatusWriter is implemented by outputs, which record collector status events.
+// missed is the number of intervals without message of a collector.
+type StatusWriter interface {
+	InsertStatus(when time.Time, ident string, exporterID string, up bool, missed int)
+}
+
+// AnomalyWriter is implemented by outputs, which record detected anomalies.
+// severity is the deviation from the baseline in standard deviations.
+type AnomalyWriter interface {
+	InsertAnomaly(when time.Time, ident string, exporterID string, proto string, metric string, value float64, baseline float64, stddev float64, severity float64)
+}
+
+// DeviationWriter is implemented by outputs, which record deviation scores
+// of a record from its seasonal baseline.
+type DeviationWriter interface {
+	InsertDeviation(when time.Time, ident string, proto string, metric string, value float64, baseline float64, score float64)
+}
+
+// InternalWriter is implemented by outputs, which record the internal counters
+// of nfinflux.
+type InternalWriter interface {
+	InsertInternal(when time.Time, counters map[string]int64)
+}
+
+// MultiWriter writes each stat record to all its outputs
+type MultiWriter []Writer
+
+// StartWrite starts all outputs. An output, which fails to start, does not
+// prevent the others from starting.
+func (writers MultiWriter) StartWrite() error {
+	var errList []error
+	for _, writer := range writers {
+		if err := writer.StartWrite(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return joinErrors(errList)
+}
+
+func (writers MultiWriter) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	for _, writer := range writers {
+		writer.InsertStat(when, ident, exporterID, interval, statRecord)
+	}
+}
+
+// InsertStatus writes the status event to all outputs, which implement StatusWriter
+func (writers MultiWriter) InsertStatus(when time.Time, ident string, exporterID string, up bool, missed int) {
+	for _, writer := range writers {
+		if statusWriter, ok := writer.(StatusWriter); ok {
+			statusWriter.InsertStatus(when, ident, exporterID, up, missed)
+		}
+	}
+}
+
+// InsertAnomaly writes the anomaly to all outputs, which implement AnomalyWriter
+func (writers MultiWriter) InsertAnomaly(when time.Time, ident string, exporterID string, proto string, metric string, value float64, baseline float64, stddev float64, severity float64) {
+	for _, writer := range writers {
+		if anomalyWriter, ok := writer.(AnomalyWriter); ok {
+			anomalyWriter.InsertAnomaly(when, ident, exporterID, proto, metric, value, baseline, stddev, severity)
+		}
+	}
+}
+
+// InsertDeviation writes the deviation score to all outputs, which implement DeviationWriter
+func (writers MultiWriter) InsertDeviation(when time.Time, ident string, proto string, metric string, value float64, baseline float64, score float64) {
+	for _, writer := range writers {
+		if deviationWriter, ok := writer.(DeviationWriter); ok {
+			deviationWriter.InsertDeviation(when, ident, proto, metric, value, baseline, score)
+		}
+	}
+}
+
+// InsertInternal writes the internal counters to all outputs, which implement InternalWriter
+func (writers MultiWriter) InsertInternal(when time.Time, counters map[string]int64) {
+	for _, writer := range writers {
+		if internalWriter, ok := writer.(InternalWriter); ok {
+			internalWriter.InsertInternal(when, counters)
+		}
+	}
+}
+
+// EndWrite ends all outputs and returns the collected errors
+func (writers MultiWriter) EndWrite() error {
+	var errList []error
+	for _, writer := range writers {
+		if err := writer.EndWrite(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return joinErrors(errList)
+}
+
+func (writers MultiWriter) Close() error {
+	var errList []error
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return joinErrors(errList)
+}
+
+func joinErrors(errList []error) error {
+	switch len(errList) {
+	case 0:
+		return nil
+	case 1:
+		return errList[0]
+	default:
+		return fmt.Errorf("%d outputs failed: %v", len(errList), errList)
+	}
+}
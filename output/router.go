@@ -0,0 +1,148 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package output
+
+import (
+	"fmt"
+	"nfinflux/nffile"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// prefix of a regular expression channel pattern
+const regexPrefix = "re:"
+
+// route sends the records of all channels matching pattern to its outputs
+type route struct {
+	pattern string
+	regex   *regexp.Regexp
+	writers MultiWriter
+}
+
+// match the channel ident against the glob or regular expression of the route
+func (route *route) match(ident string) bool {
+	if route.regex != nil {
+		return route.regex.MatchString(ident)
+	}
+	match, _ := path.Match(route.pattern, ident)
+	return match
+}
+
+// Router writes the records of a channel to the outputs of the first route,
+// which matches the channel ident. A pattern is a glob or a regular expression
+// prefixed by "re:". Records of channels without matching route are dropped,
+// so a route "*" at the end acts as default.
+type Router struct {
+	routes  []route
+	outputs MultiWriter
+	// route index of each ident seen, -1 for no route
+	cache map[string]int
+}
+
+// NewRouter creates a router for outputs. The routes select from these outputs.
+func NewRouter(outputs MultiWriter) *Router {
+	return &Router{
+		outputs: outputs,
+		cache:   make(map[string]int),
+	}
+}
+
+// AddRoute appends a route for the channels matching pattern
+func (router *Router) AddRoute(pattern string, writers MultiWriter) error {
+	newRoute := route{pattern: pattern, writers: writers}
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid channel pattern '%s': %v", pattern, err)
+		}
+		newRoute.regex = regex
+	} else if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid channel pattern '%s': %v", pattern, err)
+	}
+	router.routes = append(router.routes, newRoute)
+	return nil
+}
+
+// lookup the outputs of a channel ident
+func (router *Router) lookup(ident string) MultiWriter {
+	index, ok := router.cache[ident]
+	if !ok {
+		index = -1
+		for i := range router.routes {
+			if router.routes[i].match(ident) {
+				index = i
+				break
+			}
+		}
+		router.cache[ident] = index
+		if index < 0 {
+			fmt.Printf("No route for channel '%s' - records dropped\n", ident)
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	return router.routes[index].writers
+}
+
+func (router *Router) StartWrite() error {
+	return router.outputs.StartWrite()
+}
+
+func (router *Router) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	router.lookup(ident).InsertStat(when, ident, exporterID, interval, statRecord)
+}
+
+func (router *Router) InsertStatus(when time.Time, ident string, exporterID string, up bool, missed int) {
+	router.lookup(ident).InsertStatus(when, ident, exporterID, up, missed)
+}
+
+func (router *Router) InsertAnomaly(when time.Time, ident string, exporterID string, proto string, metric string, value float64, baseline float64, stddev float64, severity float64) {
+	router.lookup(ident).InsertAnomaly(when, ident, exporterID, proto, metric, value, baseline, stddev, severity)
+}
+
+func (router *Router) InsertDeviation(when time.Time, ident string, proto string, metric string, value float64, baseline float64, score float64) {
+	router.lookup(ident).InsertDeviation(when, ident, proto, metric, value, baseline, score)
+}
+
+// InsertInternal writes the internal counters to all outputs
+func (router *Router) InsertInternal(when time.Time, counters map[string]int64) {
+	router.outputs.InsertInternal(when, counters)
+}
+
+func (router *Router) EndWrite() error {
+	return router.outputs.EndWrite()
+}
+
+func (router *Router) Close() error {
+	return router.outputs.Close()
+}
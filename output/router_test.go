@@ -0,0 +1,113 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package output
+
+import (
+	"nfinflux/nffile"
+	"testing"
+	"time"
+)
+
+// testWriter records the channels of all stat records
+type testWriter struct {
+	channels []string
+}
+
+func (writer *testWriter) StartWrite() error {
+	return nil
+}
+
+func (writer *testWriter) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	writer.channels = append(writer.channels, ident)
+}
+
+func (writer *testWriter) EndWrite() error {
+	return nil
+}
+
+func (writer *testWriter) Close() error {
+	return nil
+}
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		ident    string
+		// index of the route getting the record, -1 for dropped
+		want int
+	}{
+		{"glob", []string{"cust1*", "*"}, "cust1-fra", 0},
+		{"first match wins", []string{"*", "cust1*"}, "cust1-fra", 0},
+		{"fall through", []string{"cust1*", "*"}, "cust2-fra", 1},
+		{"regex", []string{"cust1*", "re:^cust[0-9]+-"}, "cust2-fra", 1},
+		{"no route", []string{"cust1*", "re:^cust2-"}, "live", -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var writers []*testWriter
+			router := NewRouter(nil)
+			for _, pattern := range test.patterns {
+				writer := new(testWriter)
+				writers = append(writers, writer)
+				if err := router.AddRoute(pattern, MultiWriter{writer}); err != nil {
+					t.Fatalf("AddRoute(%q): %v", pattern, err)
+				}
+			}
+			// the second record takes the cached route
+			for i := 0; i < 2; i++ {
+				router.InsertStat(time.Now(), test.ident, "1", 0, nffile.StatRecord{})
+			}
+			for i, writer := range writers {
+				want := 0
+				if i == test.want {
+					want = 2
+				}
+				if len(writer.channels) != want {
+					t.Errorf("route %q got %d records, want %d", test.patterns[i], len(writer.channels), want)
+				}
+				for _, channel := range writer.channels {
+					if channel != test.ident {
+						t.Errorf("route %q got channel %q", test.patterns[i], channel)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAddRouteInvalid(t *testing.T) {
+	router := NewRouter(nil)
+	for _, pattern := range []string{"cust[", "re:cust("} {
+		if err := router.AddRoute(pattern, nil); err == nil {
+			t.Errorf("AddRoute(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package output
+
+import (
+	"nfinflux/nffile"
+	"sync"
+	"time"
+)
+
+// SharedWriter lets several feeders write concurrently to the same outputs.
+// The outputs are started by the first feeder and ended by the last feeder,
+// which ends writing.
+type SharedWriter struct {
+	lock   sync.Mutex
+	writer Writer
+	users  int
+}
+
+// NewSharedWriter wraps writer for concurrent use
+func NewSharedWriter(writer Writer) *SharedWriter {
+	return &SharedWriter{writer: writer}
+}
+
+func (shared *SharedWriter) StartWrite() error {
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	shared.users++
+	if shared.users > 1 {
+		return nil
+	}
+	return shared.writer.StartWrite()
+}
+
+func (shared *SharedWriter) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	shared.lock.Lock()
+	shared.writer.InsertStat(when, ident, exporterID, interval, statRecord)
+	shared.lock.Unlock()
+}
+
+func (shared *SharedWriter) InsertStatus(when time.Time, ident string, exporterID string, up bool, missed int) {
+	shared.lock.Lock()
+	if statusWriter, ok := shared.writer.(StatusWriter); ok {
+		statusWriter.InsertStatus(when, ident, exporterID, up, missed)
+	}
+	shared.lock.Unlock()
+}
+
+func (shared *SharedWriter) InsertAnomaly(when time.Time, ident string, exporterID string, proto string, metric string, value float64, baseline float64, stddev float64, severity float64) {
+	shared.lock.Lock()
+	if anomalyWriter, ok := shared.writer.(AnomalyWriter); ok {
+		anomalyWriter.InsertAnomaly(when, ident, exporterID, proto, metric, value, baseline, stddev, severity)
+	}
+	shared.lock.Unlock()
+}
+
+func (shared *SharedWriter) InsertDeviation(when time.Time, ident string, proto string, metric string, value float64, baseline float64, score float64) {
+	shared.lock.Lock()
+	if deviationWriter, ok := shared.writer.(DeviationWriter); ok {
+		deviationWriter.InsertDeviation(when, ident, proto, metric, value, baseline, score)
+	}
+	shared.lock.Unlock()
+}
+
+func (shared *SharedWriter) InsertInternal(when time.Time, counters map[string]int64) {
+	shared.lock.Lock()
+	if internalWriter, ok := shared.writer.(InternalWriter); ok {
+		internalWriter.InsertInternal(when, counters)
+	}
+	shared.lock.Unlock()
+}
+
+func (shared *SharedWriter) EndWrite() error {
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	shared.users--
+	if shared.users > 0 {
+		return nil
+	}
+	return shared.writer.EndWrite()
+}
+
+// Swap replaces the outputs by writer. If writing is started, writer is started
+// and the replaced outputs are ended. If writer fails to start, it is ended
+// again and the running outputs are kept: Swap returns nil and the error.
+// handover is called with the replaced outputs, before writer gets the first
+// record. The replaced outputs are returned to be closed.
+func (shared *SharedWriter) Swap(writer Writer, handover func(old Writer)) (Writer, error) {
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	old := shared.writer
+	if shared.users > 0 {
+		if err := writer.StartWrite(); err != nil {
+			writer.EndWrite()
+			return nil, err
+		}
+	}
+	if handover != nil {
+		handover(old)
+	}
+	var err error
+	if shared.users > 0 {
+		err = old.EndWrite()
+	}
+	shared.writer = writer
+	return old, err
+}
+
+func (shared *SharedWriter) Close() error {
+	return shared.writer.Close()
+}
@@ -0,0 +1,99 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package output
+
+import (
+	"errors"
+	"nfinflux/nffile"
+	"testing"
+	"time"
+)
+
+// swapWriter counts the records and tracks the write state
+type swapWriter struct {
+	startErr error
+	started  bool
+	records  int
+}
+
+func (writer *swapWriter) StartWrite() error {
+	writer.started = writer.startErr == nil
+	return writer.startErr
+}
+
+func (writer *swapWriter) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	writer.records++
+}
+
+func (writer *swapWriter) EndWrite() error {
+	writer.started = false
+	return nil
+}
+
+func (writer *swapWriter) Close() error {
+	return nil
+}
+
+func TestSwap(t *testing.T) {
+	tests := []struct {
+		name     string
+		startErr error
+		// outputs getting the record after the swap
+		wantNew bool
+	}{
+		{"swapped", nil, true},
+		{"start failed", errors.New("not connected"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			running := new(swapWriter)
+			shared := NewSharedWriter(running)
+			shared.StartWrite()
+
+			writer := &swapWriter{startErr: test.startErr}
+			handedOver := false
+			old, err := shared.Swap(writer, func(old Writer) { handedOver = true })
+			if (err == nil) != test.wantNew {
+				t.Fatalf("Swap: %v", err)
+			}
+			if (old == running) != test.wantNew || handedOver != test.wantNew {
+				t.Errorf("Swap returned %v, handover %v", old, handedOver)
+			}
+			if running.started == test.wantNew || writer.started != test.wantNew {
+				t.Errorf("running started %v, new started %v", running.started, writer.started)
+			}
+
+			shared.InsertStat(time.Now(), "live", "1", 0, nffile.StatRecord{})
+			if (writer.records == 1) != test.wantNew || (running.records == 1) == test.wantNew {
+				t.Errorf("record written to the new outputs %d, to the running %d", writer.records, running.records)
+			}
+		})
+	}
+}
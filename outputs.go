@@ -0,0 +1,470 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"nfinflux/alert"
+	"nfinflux/anomaly"
+	"nfinflux/config"
+	"nfinflux/graphite"
+	"nfinflux/influx"
+	"nfinflux/kafka"
+	"nfinflux/mqtt"
+	"nfinflux/nfsocket"
+	"nfinflux/otlp"
+	"nfinflux/output"
+	"nfinflux/parquet"
+	"nfinflux/postgres"
+	"nfinflux/sqlite"
+	"nfinflux/statsd"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// setup the unix socket ownership and peer credential checks of all listeners
+func setupListenOptions(owner string, group string, mode string, allowUIDs string, allowGIDs string) (*nfsocket.ListenOptions, error) {
+	options := &nfsocket.ListenOptions{SocketOwner: -1, SocketGroup: -1}
+	var err error
+	if len(owner) > 0 {
+		if options.SocketOwner, err = nfsocket.LookupUID(owner); err != nil {
+			return nil, err
+		}
+	}
+	if len(group) > 0 {
+		if options.SocketGroup, err = nfsocket.LookupGID(group); err != nil {
+			return nil, err
+		}
+	}
+	if len(mode) > 0 {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0777 {
+			return nil, fmt.Errorf("invalid socket mode: %s", mode)
+		}
+		options.SocketMode = os.FileMode(perm)
+	}
+	if options.AllowedUIDs, err = nfsocket.ParseIDList(allowUIDs, nfsocket.LookupUID); err != nil {
+		return nil, err
+	}
+	if options.AllowedGIDs, err = nfsocket.ParseIDList(allowGIDs, nfsocket.LookupGID); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// parse a comma separated list of key=value pairs
+func parseKeyValues(list string) (map[string]string, error) {
+	keyValues := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || len(key) == 0 || len(value) == 0 {
+			return nil, fmt.Errorf("invalid key=value: %s", entry)
+		}
+		keyValues[key] = value
+	}
+	return keyValues, nil
+}
+
+// setup the point schema of the influxDB output
+func setupSchema(influxDB *influx.InfluxDBConf, layout string, measurement string, wideMeasurement string, fieldNames string, tags string) error {
+	schema := influx.DefaultSchema()
+	schema.Layout = layout
+	schema.Measurement = measurement
+	schema.WideMeasurement = wideMeasurement
+	var err error
+	if schema.FieldNames, err = parseKeyValues(fieldNames); err != nil {
+		return err
+	}
+	if schema.Tags, err = parseKeyValues(tags); err != nil {
+		return err
+	}
+	return influxDB.SetSchema(schema)
+}
+
+// setup influxDB v2 or v1 output and verify the bucket
+func setupInflux(v1 bool, host string, org string, token string, bucket string, user string, password string, createBucket bool, cleanBucket bool) (*influx.InfluxDBConf, error) {
+	var influxDB *influx.InfluxDBConf
+	var err error
+	if v1 {
+		influxDB, err = influx.NewV1(host, user, password, bucket)
+	} else {
+		influxDB, err = influx.New(host, org, token, bucket, createBucket || cleanBucket)
+	}
+	if err != nil {
+		fmt.Printf("Error setup influxDB at %s: %v\n", host, err)
+		if createBucket || cleanBucket {
+			fmt.Printf("Make sure your DB parameters are correct and your token is authorized to create/delete buckets\n")
+		}
+		return nil, err
+	}
+	if _, err := influxDB.VerifyBucket(createBucket, cleanBucket); err != nil {
+		fmt.Printf("Failed to veryfy bucket '%s': %v\n", bucket, err)
+		influxDB.Close()
+		return nil, err
+	}
+	return influxDB, nil
+}
+
+// split address network://address into network and address
+func splitAddress(address string, defaultNetwork string) (string, string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return defaultNetwork, address
+}
+
+// setup graphite output for address tcp://host:port or udp://host:port
+func setupGraphite(address string, prefix string, replace string) (*graphite.GraphiteConf, error) {
+	network, address := splitAddress(address, "tcp")
+	return graphite.New(network, address, prefix, replace)
+}
+
+// setup statsd output for address udp://host:port or unixgram:///path
+func setupStatsd(address string, prefix string, tags bool, timestamp bool) (*statsd.StatsdConf, error) {
+	network, address := splitAddress(address, "udp")
+	return statsd.New(network, address, prefix, tags, timestamp)
+}
+
+// setup postgres output and verify the stat table
+func setupPostgres(dsn string, table string, createTable bool, hypertable bool) (*postgres.PostgresConf, error) {
+	pgConf, err := postgres.New(dsn, table)
+	if err != nil {
+		fmt.Printf("Error setup PostgreSQL: %v\n", err)
+		return nil, err
+	}
+	if err := pgConf.VerifyTable(createTable, hypertable); err != nil {
+		fmt.Printf("Failed to verify table '%s': %v\n", table, err)
+		pgConf.Close()
+		return nil, err
+	}
+	return pgConf, nil
+}
+
+// parse the alert rules and setup the webhook
+func setupAlert(rules string, webhook string) (*alert.AlertConf, error) {
+	ruleList, err := alert.ParseRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return alert.New(ruleList, webhook)
+}
+
+// setup all outputs of the comma separated output list of opts
+func setupOutputs(opts *options) (output.MultiWriter, error) {
+	var writers output.MultiWriter
+	for _, name := range strings.Split(opts.outputs, ",") {
+		writer, err := setupOutput(strings.TrimSpace(name), opts)
+		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+		writers = append(writers, writer)
+	}
+	return writers, nil
+} // End of setupOutputs
+
+// outputs in the order of the -output usage, with their setup from the options
+var outputTypes = []struct {
+	name  string
+	setup func(opts *options) (output.Writer, error)
+}{
+	{"influx", func(opts *options) (output.Writer, error) {
+		bucket := opts.bucket
+		if opts.v1 {
+			// v1 has no buckets - use database/retention-policy instead
+			if len(opts.database) == 0 {
+				fmt.Printf("InfluxDB 1.x requires a database name: -db\n")
+				return nil, fmt.Errorf("missing database")
+			}
+			bucket = opts.database
+			if len(opts.rp) > 0 {
+				bucket = opts.database + "/" + opts.rp
+			}
+		}
+		influxDB, err := setupInflux(opts.v1, opts.influxHost, opts.org, opts.token, bucket, opts.user, opts.password, opts.createBucket, opts.cleanBucket)
+		if err != nil {
+			return nil, err
+		}
+		influxDB.SetDerived(opts.derived)
+		if err := setupSchema(influxDB, opts.schemaLayout, opts.measurement, opts.wideMeasurement, opts.fieldNames, opts.staticTags); err != nil {
+			fmt.Printf("Error setup influxDB schema: %v\n", err)
+			influxDB.Close()
+			return nil, err
+		}
+		return influxDB, nil
+	}},
+	{"graphite", func(opts *options) (output.Writer, error) {
+		graphite, err := setupGraphite(opts.graphiteAddr, opts.graphitePrefix, opts.graphiteReplace)
+		if err != nil {
+			fmt.Printf("Error setup graphite at %s: %v\n", opts.graphiteAddr, err)
+			return nil, err
+		}
+		return graphite, nil
+	}},
+	{"otlp", func(opts *options) (output.Writer, error) {
+		otlpConf, err := otlp.New(opts.otlpProtocol, opts.otlpEndpoint, opts.otlpSum)
+		if err != nil {
+			fmt.Printf("Error setup OTLP exporter at %s: %v\n", opts.otlpEndpoint, err)
+			return nil, err
+		}
+		return otlpConf, nil
+	}},
+	{"postgres", func(opts *options) (output.Writer, error) {
+		return setupPostgres(opts.pgDSN, opts.pgTable, opts.createBucket, opts.pgHypertable)
+	}},
+	{"sqlite", func(opts *options) (output.Writer, error) {
+		sqliteConf, err := sqlite.New(opts.sqliteFile, opts.sqliteRetention)
+		if err != nil {
+			fmt.Printf("Error setup SQLite: %v\n", err)
+			return nil, err
+		}
+		return sqliteConf, nil
+	}},
+	{"parquet", func(opts *options) (output.Writer, error) {
+		parquetConf, err := parquet.New(opts.parquetDir, opts.parquetRoll)
+		if err != nil {
+			fmt.Printf("Error setup Parquet output: %v\n", err)
+			return nil, err
+		}
+		return parquetConf, nil
+	}},
+	{"kafka", func(opts *options) (output.Writer, error) {
+		kafkaConf, err := kafka.New(opts.kafkaBrokers, opts.kafkaTopic, opts.kafkaFormat, opts.kafkaCompress, opts.kafkaAcks)
+		if err != nil {
+			fmt.Printf("Error setup Kafka producer: %v\n", err)
+			return nil, err
+		}
+		return kafkaConf, nil
+	}},
+	{"mqtt", func(opts *options) (output.Writer, error) {
+		mqttConf, err := mqtt.New(opts.mqttBroker, opts.mqttTopic, opts.mqttQos, opts.mqttRetain, opts.mqttUser, opts.mqttPassword)
+		if err != nil {
+			fmt.Printf("Error setup MQTT client: %v\n", err)
+			return nil, err
+		}
+		return mqttConf, nil
+	}},
+	{"statsd", func(opts *options) (output.Writer, error) {
+		statsdConf, err := setupStatsd(opts.statsdAddr, opts.statsdPrefix, opts.statsdTags, opts.statsdTimestamp)
+		if err != nil {
+			fmt.Printf("Error setup StatsD output at %s: %v\n", opts.statsdAddr, err)
+			return nil, err
+		}
+		return statsdConf, nil
+	}},
+}
+
+// names of all outputs
+func outputNames() []string {
+	var names []string
+	for _, outputType := range outputTypes {
+		names = append(names, outputType.name)
+	}
+	return names
+}
+
+// setup the output name with the options opts
+func setupOutput(name string, opts *options) (output.Writer, error) {
+	for _, outputType := range outputTypes {
+		if outputType.name == name {
+			return outputType.setup(opts)
+		}
+	}
+	fmt.Printf("Unknown output: %s\n", name)
+	return nil, fmt.Errorf("unknown output: %s", name)
+} // End of setupOutput
+
+// parse the -route list channel=bucket[@org][:token] into influxDB outputs and
+// their routes. Channels with the same bucket and org share one output. The
+// pattern ends at the first '=', as tokens may end with '=' padding.
+func parseRoutes(list string, v1 bool) ([]config.Output, []config.Route, error) {
+	var outputs []config.Output
+	var routes []config.Route
+	tokens := make(map[string]string)
+	for _, entry := range splitList(list) {
+		pattern, target, _ := strings.Cut(entry, "=")
+		if len(pattern) == 0 || len(target) == 0 {
+			return nil, nil, fmt.Errorf("invalid route: %s", entry)
+		}
+		// the output name must not contain the token, as it is logged
+		target, token, hasToken := strings.Cut(target, ":")
+		if hasToken && len(token) == 0 {
+			return nil, nil, fmt.Errorf("route %s: empty token", pattern)
+		}
+		if hasToken && v1 {
+			return nil, nil, fmt.Errorf("route %s: tokens are not supported with -v1", pattern)
+		}
+		if prevToken, ok := tokens[target]; ok {
+			if prevToken != token {
+				return nil, nil, fmt.Errorf("route %s: different tokens for %s", pattern, target)
+			}
+		} else {
+			tokens[target] = token
+			bucket, org, _ := strings.Cut(target, "@")
+			options := map[string]string{"bucket": bucket}
+			if v1 {
+				options = map[string]string{"db": bucket}
+			}
+			if len(org) > 0 {
+				options["org"] = org
+			}
+			if hasToken {
+				options["token"] = token
+			}
+			outputs = append(outputs, config.Output{Name: target, Type: "influx", Options: options})
+		}
+		routes = append(routes, config.Route{Channel: pattern, Outputs: config.StringList{target}})
+	}
+	return outputs, routes, nil
+} // End of parseRoutes
+
+// setup the named outputs of the config file and route the channels to them.
+// Without outputs in the config file, the -output list is used. The -route
+// list adds influxDB outputs with routes before the routes of the config file.
+// Without routes in the config file, the channels of no -route are written to
+// the other outputs as default. Without any routes all records are written to
+// all outputs.
+func setupRouting(opts *options, conf *config.Config) (output.Writer, error) {
+	if len(conf.Outputs) == 0 && len(conf.Routes) == 0 && len(opts.routes) == 0 {
+		return setupOutputs(opts)
+	}
+
+	outputs := conf.Outputs
+	if len(outputs) == 0 {
+		for _, name := range strings.Split(opts.outputs, ",") {
+			name = strings.TrimSpace(name)
+			outputs = append(outputs, config.Output{Name: name, Type: name})
+		}
+	}
+	routes := conf.Routes
+	if len(opts.routes) > 0 {
+		routeOutputs, flagRoutes, err := parseRoutes(opts.routes, opts.v1)
+		if err != nil {
+			return nil, err
+		}
+		if len(routes) == 0 {
+			defaultRoute := config.Route{Channel: "*"}
+			for _, entry := range outputs {
+				defaultRoute.Outputs = append(defaultRoute.Outputs, entry.Name)
+			}
+			routes = append(routes, defaultRoute)
+		}
+		outputs = append(outputs, routeOutputs...)
+		routes = append(flagRoutes, routes...)
+	}
+
+	var writers output.MultiWriter
+	namedWriters := make(map[string]output.Writer)
+	for _, entry := range outputs {
+		if _, ok := namedWriters[entry.Name]; ok {
+			writers.Close()
+			return nil, fmt.Errorf("duplicate output name: %s", entry.Name)
+		}
+		outputOpts, err := opts.outputOptions(entry.Name, entry.Options)
+		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+		writer, err := setupOutput(entry.Type, outputOpts)
+		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+		writers = append(writers, writer)
+		namedWriters[entry.Name] = writer
+	}
+	if len(routes) == 0 {
+		return writers, nil
+	}
+
+	router := output.NewRouter(writers)
+	for _, route := range routes {
+		var routeWriters output.MultiWriter
+		for _, name := range route.Outputs {
+			writer, ok := namedWriters[name]
+			if !ok {
+				writers.Close()
+				return nil, fmt.Errorf("route %s: unknown output: %s", route.Channel, name)
+			}
+			routeWriters = append(routeWriters, writer)
+		}
+		if err := router.AddRoute(route.Channel, routeWriters); err != nil {
+			writers.Close()
+			return nil, err
+		}
+	}
+	return router, nil
+} // End of setupRouting
+
+// setup the outputs with their routes and the alert and anomaly stages
+func setupPipeline(opts *options, conf *config.Config, liveMode bool) (output.MultiWriter, error) {
+	sink, err := setupRouting(opts, conf)
+	if err != nil {
+		return nil, err
+	}
+	writers := output.MultiWriter{sink}
+
+	// without rules, the webhook gets the collector liveness events only
+	if len(opts.alertRules) > 0 || len(opts.alertWebhook) > 0 {
+		alertConf, err := setupAlert(opts.alertRules, opts.alertWebhook)
+		if err != nil {
+			writers.Close()
+			return nil, fmt.Errorf("alerts: %v", err)
+		}
+		writers = append(writers, alertConf)
+	}
+
+	if opts.anomalyDetect {
+		// anomalies are written to the outputs selected so far
+		ewmaConf, err := anomaly.New(opts.anomalyAlpha, opts.anomalySigma, opts.anomalyState, writers)
+		if err != nil {
+			writers.Close()
+			return nil, err
+		}
+		writers = append(writers, ewmaConf)
+	}
+
+	if opts.seasonal {
+		if liveMode {
+			writers.Close()
+			return nil, fmt.Errorf("seasonal analysis requires imported files")
+		}
+		// the analysis runs at the end of the import and must write its
+		// scores, before the other outputs end writing
+		seasonalConf := anomaly.NewSeasonal(opts.seasonalScore, writers)
+		writers = append(output.MultiWriter{seasonalConf}, writers...)
+	}
+	return writers, nil
+} // End of setupPipeline
@@ -0,0 +1,84 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		list    string
+		v1      bool
+		outputs []string
+		options []map[string]string
+		wantErr bool
+	}{
+		{list: "cust1*=Cust1", outputs: []string{"Cust1"},
+			options: []map[string]string{{"bucket": "Cust1"}}},
+		{list: "cust1*=Cust1, cust1b=Cust1", outputs: []string{"Cust1"},
+			options: []map[string]string{{"bucket": "Cust1"}}},
+		{list: "re:^cust2-=Cust2@Org2:abc==", outputs: []string{"Cust2@Org2"},
+			options: []map[string]string{{"bucket": "Cust2", "org": "Org2", "token": "abc=="}}},
+		{list: "cust1*=Cust1", v1: true, outputs: []string{"Cust1"},
+			options: []map[string]string{{"db": "Cust1"}}},
+		{list: "cust1*=Cust1:abc", v1: true, wantErr: true},
+		{list: "cust1*=Cust1:", wantErr: true},
+		{list: "cust1*=Cust1:abc,cust1b=Cust1:def", wantErr: true},
+		{list: "=Cust1", wantErr: true},
+		{list: "cust1*=", wantErr: true},
+	}
+	for _, test := range tests {
+		outputs, routes, err := parseRoutes(test.list, test.v1)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseRoutes(%q) accepted an invalid route", test.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRoutes(%q): %v", test.list, err)
+			continue
+		}
+		var names []string
+		var options []map[string]string
+		for _, output := range outputs {
+			names = append(names, output.Name)
+			options = append(options, output.Options)
+		}
+		if !reflect.DeepEqual(names, test.outputs) || !reflect.DeepEqual(options, test.options) {
+			t.Errorf("parseRoutes(%q) outputs %v %v, want %v %v", test.list, names, options, test.outputs, test.options)
+		}
+		if len(routes) != len(splitList(test.list)) {
+			t.Errorf("parseRoutes(%q) got %d routes", test.list, len(routes))
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * parquet writes the stat records into Parquet files, partitioned by day and
+ * channel in Hive style:
+ *   <dir>/date=2022-03-03/channel=<ident>/stat-<created>.parquet
+ * Files are written as .tmp and renamed, when they are closed. A file is
+ * rolled, when the day changes or it has been open longer than the roll interval.
+ */
+
+package parquet
+
+import (
+	"fmt"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	parquetgo "github.com/parquet-go/parquet-go"
+)
+
+// max time rows are buffered, before they are written to the file
+const flushInterval = 5 * time.Second
+
+// statRow covers all counters of nffile.StatRecord
+type statRow struct {
+	Time            int64  `parquet:"time,timestamp(millisecond)"`
+	Channel         string `parquet:"channel,dict"`
+	Exporter        string `parquet:"exporter,dict"`
+	Interval        int32  `parquet:"interval"`
+	Flows           int64  `parquet:"flows"`
+	Bytes           int64  `parquet:"bytes"`
+	Packets         int64  `parquet:"packets"`
+	FlowsTcp        int64  `parquet:"flows_tcp"`
+	FlowsUdp        int64  `parquet:"flows_udp"`
+	FlowsIcmp       int64  `parquet:"flows_icmp"`
+	FlowsOther      int64  `parquet:"flows_other"`
+	BytesTcp        int64  `parquet:"bytes_tcp"`
+	BytesUdp        int64  `parquet:"bytes_udp"`
+	BytesIcmp       int64  `parquet:"bytes_icmp"`
+	BytesOther      int64  `parquet:"bytes_other"`
+	PacketsTcp      int64  `parquet:"packets_tcp"`
+	PacketsUdp      int64  `parquet:"packets_udp"`
+	PacketsIcmp     int64  `parquet:"packets_icmp"`
+	PacketsOther    int64  `parquet:"packets_other"`
+	FirstSeen       int64  `parquet:"first_seen,timestamp(millisecond)"`
+	LastSeen        int64  `parquet:"last_seen,timestamp(millisecond)"`
+	SequenceFailure int64  `parquet:"sequence_failure"`
+}
+
+// an open partition file
+type partFile struct {
+	day      string
+	fileName string
+	file     *os.File
+	writer   *parquetgo.GenericWriter[statRow]
+	rows     []statRow
+	opened   time.Time
+}
+
+type ParquetConf struct {
+	dir          string
+	rollInterval time.Duration
+	lock         sync.Mutex
+	// open files per channel
+	files   map[string]*partFile
+	errList []error
+	done    chan bool
+	wg      sync.WaitGroup
+}
+
+// New creates a Parquet output in directory dir. Files are rolled after rollInterval.
+func New(dir string, rollInterval time.Duration) (*ParquetConf, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	parquetConf := new(ParquetConf)
+	parquetConf.dir = dir
+	parquetConf.rollInterval = rollInterval
+	parquetConf.files = make(map[string]*partFile)
+	return parquetConf, nil
+} // End of New
+
+// convert an ident into a valid directory name
+func sanitize(ident string) string {
+	ident = strings.Map(func(c rune) rune {
+		if c == '/' || c == '\\' || c == '=' || c < ' ' {
+			return '_'
+		}
+		return c
+	}, ident)
+	if len(ident) == 0 || ident == "." || ident == ".." {
+		return "unknown"
+	}
+	return ident
+}
+
+func (parquetConf *ParquetConf) StartWrite() error {
+	parquetConf.done = make(chan bool)
+	parquetConf.wg.Add(1)
+	go func() {
+		defer parquetConf.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				parquetConf.Flush()
+			case <-parquetConf.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (parquetConf *ParquetConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	channel := sanitize(ident)
+	day := when.UTC().Format("2006-01-02")
+
+	row := statRow{
+		Time:            when.UnixMilli(),
+		Channel:         channel,
+		Exporter:        exporterID,
+		Interval:        int32(interval),
+		Flows:           int64(statRecord.Numflows),
+		Bytes:           int64(statRecord.Numbytes),
+		Packets:         int64(statRecord.Numpackets),
+		FlowsTcp:        int64(statRecord.NumflowsTcp),
+		FlowsUdp:        int64(statRecord.NumflowsUdp),
+		FlowsIcmp:       int64(statRecord.NumflowsIcmp),
+		FlowsOther:      int64(statRecord.NumflowsOther),
+		BytesTcp:        int64(statRecord.NumbytesTcp),
+		BytesUdp:        int64(statRecord.NumbytesUdp),
+		BytesIcmp:       int64(statRecord.NumbytesIcmp),
+		BytesOther:      int64(statRecord.NumbytesOther),
+		PacketsTcp:      int64(statRecord.NumpacketsTcp),
+		PacketsUdp:      int64(statRecord.NumpacketsUdp),
+		PacketsIcmp:     int64(statRecord.NumpacketsIcmp),
+		PacketsOther:    int64(statRecord.NumpacketsOther),
+		FirstSeen:       int64(statRecord.FirstSeen),
+		LastSeen:        int64(statRecord.LastSeen),
+		SequenceFailure: int64(statRecord.SequenceFailure),
+	}
+
+	parquetConf.lock.Lock()
+	defer parquetConf.lock.Unlock()
+
+	part := parquetConf.files[channel]
+	if part != nil && part.day != day {
+		parquetConf.closeFile(part)
+		part = nil
+	}
+	if part == nil {
+		var err error
+		if part, err = parquetConf.openFile(day, channel); err != nil {
+			fmt.Printf("parquet open error: %v\n", err)
+			parquetConf.errList = append(parquetConf.errList, err)
+			metrics.PointsFailed.Add(1)
+			return
+		}
+		parquetConf.files[channel] = part
+	}
+	part.rows = append(part.rows, row)
+}
+
+func (parquetConf *ParquetConf) openFile(day string, channel string) (*partFile, error) {
+	dir := filepath.Join(parquetConf.dir, "date="+day, "channel="+channel)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	fileName := filepath.Join(dir, "stat-"+now.UTC().Format("20060102T150405.000")+".parquet")
+	file, err := os.Create(fileName + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	part := &partFile{
+		day:      day,
+		fileName: fileName,
+		file:     file,
+		writer:   parquetgo.NewGenericWriter[statRow](file, parquetgo.Compression(&parquetgo.Snappy)),
+		opened:   now,
+	}
+	return part, nil
+}
+
+// write buffered rows of a partition file
+func (parquetConf *ParquetConf) writeRows(part *partFile) {
+	if len(part.rows) == 0 {
+		return
+	}
+	if _, err := part.writer.Write(part.rows); err != nil {
+		fmt.Printf("parquet write error: %v\n", err)
+		metrics.WriteErrors.Add(1)
+		metrics.PointsFailed.Add(int64(len(part.rows)))
+		parquetConf.errList = append(parquetConf.errList, err)
+	} else {
+		metrics.PointsWritten.Add(int64(len(part.rows)))
+	}
+	part.rows = part.rows[:0]
+}
+
+// close and rename a partition file
+func (parquetConf *ParquetConf) closeFile(part *partFile) {
+	parquetConf.writeRows(part)
+	err := part.writer.Close()
+	if err == nil {
+		err = part.file.Close()
+	} else {
+		part.file.Close()
+	}
+	if err == nil {
+		err = os.Rename(part.fileName+".tmp", part.fileName)
+	}
+	if err != nil {
+		fmt.Printf("parquet close error: %v\n", err)
+		parquetConf.errList = append(parquetConf.errList, err)
+	}
+}
+
+// Flush writes all buffered rows and rolls files open longer than the roll interval
+func (parquetConf *ParquetConf) Flush() {
+	parquetConf.lock.Lock()
+	defer parquetConf.lock.Unlock()
+
+	for channel, part := range parquetConf.files {
+		if parquetConf.rollInterval > 0 && time.Since(part.opened) > parquetConf.rollInterval {
+			parquetConf.closeFile(part)
+			delete(parquetConf.files, channel)
+		} else {
+			parquetConf.writeRows(part)
+		}
+	}
+}
+
+// EndWrite closes all open files
+func (parquetConf *ParquetConf) EndWrite() error {
+	if parquetConf.done != nil {
+		close(parquetConf.done)
+		parquetConf.wg.Wait()
+		parquetConf.done = nil
+	}
+
+	parquetConf.lock.Lock()
+	defer parquetConf.lock.Unlock()
+	for channel, part := range parquetConf.files {
+		parquetConf.closeFile(part)
+		delete(parquetConf.files, channel)
+	}
+	if parquetConf.errList != nil {
+		return fmt.Errorf("parquet failed writes: %d", len(parquetConf.errList))
+	}
+	return nil
+}
+
+func (parquetConf *ParquetConf) Close() error {
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * postgres writes the stat records as rows
+ *   (time, channel, exporter, proto, flows, packets, bytes)
+ * into a PostgreSQL or TimescaleDB table using batched COPY
+ */
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// number of buffered rows, before they are copied into the table
+const batchSize = 5000
+
+// max time rows are buffered
+const flushInterval = 5 * time.Second
+
+type statRow struct {
+	when     time.Time
+	channel  string
+	exporter string
+	proto    string
+	interval int
+	flows    int64
+	packets  int64
+	bytes    int64
+}
+
+type PostgresConf struct {
+	schema  string
+	table   string
+	db      *sql.DB
+	lock    sync.Mutex
+	rows    []statRow
+	errList []error
+	done    chan bool
+	wg      sync.WaitGroup
+}
+
+// New connects to the database given by the connection string dsn.
+// table may be given as 'schema.table'.
+func New(dsn string, table string) (*PostgresConf, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	pgConf := new(PostgresConf)
+	pgConf.db = db
+	if i := strings.Index(table, "."); i >= 0 {
+		pgConf.schema = table[:i]
+		pgConf.table = table[i+1:]
+	} else {
+		pgConf.table = table
+	}
+	return pgConf, nil
+} // End of New
+
+// quoted table name for SQL statements
+func (pgConf *PostgresConf) tableName() string {
+	if len(pgConf.schema) > 0 {
+		return pq.QuoteIdentifier(pgConf.schema) + "." + pq.QuoteIdentifier(pgConf.table)
+	}
+	return pq.QuoteIdentifier(pgConf.table)
+}
+
+// VerifyTable checks, if the stat table exists and creates it, if requested.
+// If hypertable is set, the table is converted into a TimescaleDB hypertable.
+func (pgConf *PostgresConf) VerifyTable(createMissing bool, hypertable bool) error {
+	var exists bool
+	query := "SELECT to_regclass($1) IS NOT NULL"
+	if err := pgConf.db.QueryRow(query, pgConf.tableName()).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if !createMissing {
+		return fmt.Errorf("table %s does not exist", pgConf.tableName())
+	}
+
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		time     TIMESTAMPTZ NOT NULL,
+		channel  TEXT NOT NULL,
+		exporter TEXT NOT NULL,
+		proto    TEXT NOT NULL,
+		interval INTEGER NOT NULL DEFAULT 0,
+		flows    BIGINT NOT NULL,
+		packets  BIGINT NOT NULL,
+		bytes    BIGINT NOT NULL
+	)`, pgConf.tableName())
+	if _, err := pgConf.db.Exec(create); err != nil {
+		return err
+	}
+
+	if hypertable {
+		if _, err := pgConf.db.Exec("SELECT create_hypertable($1, 'time', if_not_exists => TRUE)", pgConf.tableName()); err != nil {
+			return fmt.Errorf("create hypertable: %v", err)
+		}
+	} else {
+		index := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (time)", pq.QuoteIdentifier(pgConf.table+"_time_idx"), pgConf.tableName())
+		if _, err := pgConf.db.Exec(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pgConf *PostgresConf) StartWrite() error {
+	pgConf.done = make(chan bool)
+	pgConf.wg.Add(1)
+	go func() {
+		defer pgConf.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pgConf.Flush()
+			case <-pgConf.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (pgConf *PostgresConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	pgConf.lock.Lock()
+	pgConf.rows = append(pgConf.rows,
+		statRow{when, ident, exporterID, "tcp", interval, int64(statRecord.NumflowsTcp), int64(statRecord.NumpacketsTcp), int64(statRecord.NumbytesTcp)},
+		statRow{when, ident, exporterID, "udp", interval, int64(statRecord.NumflowsUdp), int64(statRecord.NumpacketsUdp), int64(statRecord.NumbytesUdp)},
+		statRow{when, ident, exporterID, "icmp", interval, int64(statRecord.NumflowsIcmp), int64(statRecord.NumpacketsIcmp), int64(statRecord.NumbytesIcmp)},
+		statRow{when, ident, exporterID, "other", interval, int64(statRecord.NumflowsOther), int64(statRecord.NumpacketsOther), int64(statRecord.NumbytesOther)},
+	)
+	numRows := len(pgConf.rows)
+	pgConf.lock.Unlock()
+
+	if numRows >= batchSize {
+		pgConf.Flush()
+	}
+}
+
+// Flush copies all buffered rows into the table
+func (pgConf *PostgresConf) Flush() {
+	pgConf.lock.Lock()
+	rows := pgConf.rows
+	pgConf.rows = nil
+	pgConf.lock.Unlock()
+
+	if len(rows) == 0 {
+		return
+	}
+	if err := pgConf.copyRows(rows); err != nil {
+		fmt.Printf("postgres write error: %v\n", err)
+		metrics.WriteErrors.Add(1)
+		metrics.PointsFailed.Add(int64(len(rows)))
+		pgConf.lock.Lock()
+		pgConf.errList = append(pgConf.errList, err)
+		pgConf.lock.Unlock()
+		return
+	}
+	metrics.PointsWritten.Add(int64(len(rows)))
+}
+
+func (pgConf *PostgresConf) copyRows(rows []statRow) error {
+	txn, err := pgConf.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"time", "channel", "exporter", "proto", "interval", "flows", "packets", "bytes"}
+	copyStmt := pq.CopyIn(pgConf.table, columns...)
+	if len(pgConf.schema) > 0 {
+		copyStmt = pq.CopyInSchema(pgConf.schema, pgConf.table, columns...)
+	}
+	stmt, err := txn.Prepare(copyStmt)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row.when, row.channel, row.exporter, row.proto, row.interval, row.flows, row.packets, row.bytes); err != nil {
+			stmt.Close()
+			txn.Rollback()
+			return err
+		}
+	}
+
+	// flush COPY buffer
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		txn.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func (pgConf *PostgresConf) EndWrite() error {
+	if pgConf.done != nil {
+		close(pgConf.done)
+		pgConf.wg.Wait()
+		pgConf.done = nil
+	}
+	pgConf.Flush()
+
+	pgConf.lock.Lock()
+	defer pgConf.lock.Unlock()
+	if pgConf.errList != nil {
+		return fmt.Errorf("postgres failed writes: %d", len(pgConf.errList))
+	}
+	return nil
+}
+
+func (pgConf *PostgresConf) Close() error {
+	return pgConf.db.Close()
+}
@@ -0,0 +1,139 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"nfinflux/alert"
+	"nfinflux/anomaly"
+	"nfinflux/config"
+	"nfinflux/output"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// options of the inputs, which can't be changed without restart
+var restartOptions = []string{
+	"socket", "listen", "watch", "tls-cert", "tls-key", "tls-ca", "tls-idents",
+	"socket-owner", "socket-group", "socket-mode", "allow-uid", "allow-gid",
+	"counters", "missed", "twin", "stats-listen", "stats-interval",
+}
+
+// reload the configuration on SIGHUP. running is the config file at startup.
+func setupReloadHandler(running *config.Config, shared *output.SharedWriter) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reload(running, shared)
+		}
+	}()
+}
+
+// reload the command line options and the config file and replace the outputs
+// of shared. Sockets and queued metrics are kept. Changed inputs are reported
+// and ignored.
+func reload(running *config.Config, shared *output.SharedWriter) {
+	fmt.Printf("nfinflux reload configuration\n")
+	opts := newOptions()
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	opts.register(flagSet)
+	if err := flagSet.Parse(os.Args[1:]); err != nil {
+		fmt.Printf("Reload failed: %v - keep running configuration\n", err)
+		return
+	}
+	conf := &config.Config{}
+	if len(opts.config) > 0 {
+		var err error
+		if conf, err = config.Load(opts.config); err != nil {
+			fmt.Printf("Reload failed: %v - keep running configuration\n", err)
+			return
+		}
+		if err := applyFile(flagSet, conf.Options); err != nil {
+			fmt.Printf("Reload failed: %s: %v - keep running configuration\n", opts.config, err)
+			return
+		}
+	}
+
+	for _, name := range restartOptions {
+		if flagSet.Lookup(name).Value.String() != flag.Lookup(name).Value.String() {
+			fmt.Printf("Reload: option %s changed - restart nfinflux to apply\n", name)
+		}
+	}
+	if !reflect.DeepEqual(conf.Inputs, running.Inputs) {
+		fmt.Printf("Reload: inputs changed - restart nfinflux to apply\n")
+	}
+
+	// never delete existing buckets of a running nfinflux
+	opts.cleanBucket = false
+	writers, err := setupPipeline(opts, conf, true)
+	if err != nil {
+		fmt.Printf("Reload failed: %v - keep running configuration\n", err)
+		return
+	}
+	old, err := shared.Swap(writers, func(old output.Writer) {
+		takeover(old, writers)
+	})
+	if old == nil {
+		fmt.Printf("Reload failed: %v - keep running configuration\n", err)
+		writers.Close()
+		return
+	}
+	if err != nil {
+		fmt.Printf("Reload: replaced outputs: %v\n", err)
+	}
+	old.Close()
+	fmt.Printf("nfinflux configuration reloaded\n")
+} // End of reload
+
+// continue the alert and anomaly state of the replaced outputs old
+func takeover(old output.Writer, writers output.MultiWriter) {
+	oldWriters, ok := old.(output.MultiWriter)
+	if !ok {
+		return
+	}
+	for _, writer := range writers {
+		for _, oldWriter := range oldWriters {
+			switch writer := writer.(type) {
+			case *alert.AlertConf:
+				if oldAlert, ok := oldWriter.(*alert.AlertConf); ok {
+					writer.Takeover(oldAlert)
+				}
+			case *anomaly.EwmaConf:
+				if oldEwma, ok := oldWriter.(*anomaly.EwmaConf); ok {
+					writer.Takeover(oldEwma)
+				}
+			}
+		}
+	}
+} // End of takeover
@@ -0,0 +1,244 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * sqlite stores the stat records in a local SQLite database file for
+ * standalone deployments without a TSDB. Records older than the retention
+ * time are pruned automatically.
+ */
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// number of buffered rows, before they are written
+const batchSize = 5000
+
+// max time rows are buffered
+const flushInterval = 5 * time.Second
+
+// interval to prune expired records
+const pruneInterval = time.Hour
+
+const schema = `
+CREATE TABLE IF NOT EXISTS stat (
+	time     INTEGER NOT NULL, -- msec since epoch
+	channel  TEXT NOT NULL,
+	exporter TEXT NOT NULL,
+	proto    TEXT NOT NULL,
+	interval INTEGER NOT NULL DEFAULT 0, -- sec
+	flows    INTEGER NOT NULL,
+	packets  INTEGER NOT NULL,
+	bytes    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS stat_time_idx ON stat (time);
+CREATE INDEX IF NOT EXISTS stat_channel_idx ON stat (channel, time);
+`
+
+type statRow struct {
+	when     int64
+	channel  string
+	exporter string
+	proto    string
+	interval int
+	flows    int64
+	packets  int64
+	bytes    int64
+}
+
+type SqliteConf struct {
+	fileName  string
+	retention time.Duration
+	db        *sql.DB
+	lock      sync.Mutex
+	rows      []statRow
+	// newest record time is the reference for pruning, which also works for imports
+	newest    int64
+	lastPrune time.Time
+	errList   []error
+	done      chan bool
+	wg        sync.WaitGroup
+}
+
+// New opens or creates the SQLite database fileName. Records older than
+// retention are pruned. A retention of 0 keeps all records.
+func New(fileName string, retention time.Duration) (*SqliteConf, error) {
+	db, err := sql.Open("sqlite3", "file:"+fileName+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// serialize all writes
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite create schema in %s: %v", fileName, err)
+	}
+
+	sqliteConf := new(SqliteConf)
+	sqliteConf.fileName = fileName
+	sqliteConf.retention = retention
+	sqliteConf.db = db
+	return sqliteConf, nil
+} // End of New
+
+func (sqliteConf *SqliteConf) StartWrite() error {
+	sqliteConf.done = make(chan bool)
+	sqliteConf.wg.Add(1)
+	go func() {
+		defer sqliteConf.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sqliteConf.Flush()
+			case <-sqliteConf.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (sqliteConf *SqliteConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	msec := when.UnixMilli()
+
+	sqliteConf.lock.Lock()
+	sqliteConf.rows = append(sqliteConf.rows,
+		statRow{msec, ident, exporterID, "tcp", interval, int64(statRecord.NumflowsTcp), int64(statRecord.NumpacketsTcp), int64(statRecord.NumbytesTcp)},
+		statRow{msec, ident, exporterID, "udp", interval, int64(statRecord.NumflowsUdp), int64(statRecord.NumpacketsUdp), int64(statRecord.NumbytesUdp)},
+		statRow{msec, ident, exporterID, "icmp", interval, int64(statRecord.NumflowsIcmp), int64(statRecord.NumpacketsIcmp), int64(statRecord.NumbytesIcmp)},
+		statRow{msec, ident, exporterID, "other", interval, int64(statRecord.NumflowsOther), int64(statRecord.NumpacketsOther), int64(statRecord.NumbytesOther)},
+	)
+	if msec > sqliteConf.newest {
+		sqliteConf.newest = msec
+	}
+	numRows := len(sqliteConf.rows)
+	sqliteConf.lock.Unlock()
+
+	if numRows >= batchSize {
+		sqliteConf.Flush()
+	}
+}
+
+// Flush writes all buffered rows in one transaction and prunes expired records
+func (sqliteConf *SqliteConf) Flush() {
+	sqliteConf.lock.Lock()
+	rows := sqliteConf.rows
+	sqliteConf.rows = nil
+	newest := sqliteConf.newest
+	doPrune := sqliteConf.retention > 0 && newest > 0 && time.Since(sqliteConf.lastPrune) > pruneInterval
+	if doPrune {
+		sqliteConf.lastPrune = time.Now()
+	}
+	sqliteConf.lock.Unlock()
+
+	if len(rows) > 0 {
+		if err := sqliteConf.insertRows(rows); err != nil {
+			fmt.Printf("sqlite write error: %v\n", err)
+			metrics.WriteErrors.Add(1)
+			metrics.PointsFailed.Add(int64(len(rows)))
+			sqliteConf.lock.Lock()
+			sqliteConf.errList = append(sqliteConf.errList, err)
+			sqliteConf.lock.Unlock()
+		} else {
+			metrics.PointsWritten.Add(int64(len(rows)))
+		}
+	}
+
+	if doPrune {
+		if err := sqliteConf.prune(newest); err != nil {
+			fmt.Printf("sqlite prune error: %v\n", err)
+		}
+	}
+}
+
+func (sqliteConf *SqliteConf) insertRows(rows []statRow) error {
+	txn, err := sqliteConf.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := txn.Prepare("INSERT INTO stat (time, channel, exporter, proto, interval, flows, packets, bytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row.when, row.channel, row.exporter, row.proto, row.interval, row.flows, row.packets, row.bytes); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// delete all records older than retention, relative to the newest record
+func (sqliteConf *SqliteConf) prune(newest int64) error {
+	limit := newest - sqliteConf.retention.Milliseconds()
+	result, err := sqliteConf.db.Exec("DELETE FROM stat WHERE time < ?", limit)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		fmt.Printf("sqlite pruned %d records older than %v\n", n, time.UnixMilli(limit))
+	}
+	return nil
+}
+
+func (sqliteConf *SqliteConf) EndWrite() error {
+	if sqliteConf.done != nil {
+		close(sqliteConf.done)
+		sqliteConf.wg.Wait()
+		sqliteConf.done = nil
+	}
+	sqliteConf.Flush()
+
+	sqliteConf.lock.Lock()
+	defer sqliteConf.lock.Unlock()
+	if sqliteConf.errList != nil {
+		return fmt.Errorf("sqlite failed writes: %d", len(sqliteConf.errList))
+	}
+	return nil
+}
+
+func (sqliteConf *SqliteConf) Close() error {
+	return sqliteConf.db.Close()
+}
@@ -0,0 +1,203 @@
+/*
+ *  Copyright (c) 2022, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+ * statsd sends the stat records as gauges to a StatsD or DogStatsD server
+ * over UDP or a unix datagram socket. With DogStatsD tags, a gauge looks like
+ *   nfinflux.flows:13|g|#channel:live,exporter:0,proto:tcp
+ * without tags, channel, exporter and proto become part of the name
+ *   nfinflux.live.0.tcp.flows:13|g
+ */
+
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"nfinflux/metrics"
+	"nfinflux/nffile"
+	"strings"
+	"time"
+)
+
+type StatsdConf struct {
+	network   string
+	address   string
+	prefix    string
+	tags      bool
+	timestamp bool
+	maxSize   int
+	conn      net.Conn
+	buf       bytes.Buffer
+	errCount  int
+}
+
+// New creates a StatsD output. network is "udp" or "unixgram". If tags is set,
+// DogStatsD tags are used. If timestamp is set, the record time is sent with
+// each gauge (DogStatsD protocol v1.3).
+func New(network string, address string, prefix string, tags bool, timestamp bool) (*StatsdConf, error) {
+	statsdConf := new(StatsdConf)
+	switch network {
+	case "udp":
+		// stay below a common MTU
+		statsdConf.maxSize = 1432
+	case "unixgram":
+		statsdConf.maxSize = 8192
+	default:
+		return nil, fmt.Errorf("statsd: unsupported network: %s", network)
+	}
+	statsdConf.network = network
+	statsdConf.address = address
+	statsdConf.prefix = strings.Trim(prefix, ".")
+	statsdConf.tags = tags
+	statsdConf.timestamp = timestamp
+	return statsdConf, nil
+} // End of New
+
+// sanitize a name for a metric name or tag value
+func sanitize(name string, replace string) string {
+	var sb strings.Builder
+	for _, c := range name {
+		switch c {
+		case ':', '|', ',', '#', '@', ' ', '\n':
+			sb.WriteString(replace)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	if sb.Len() == 0 {
+		return "unknown"
+	}
+	return sb.String()
+}
+
+func (statsdConf *StatsdConf) StartWrite() error {
+	// datagram sockets do not need a server to connect
+	conn, err := net.Dial(statsdConf.network, statsdConf.address)
+	if err != nil {
+		return fmt.Errorf("statsd: %v", err)
+	}
+	statsdConf.conn = conn
+	return nil
+}
+
+// add a gauge to the datagram buffer and send the buffer, if full
+func (statsdConf *StatsdConf) gauge(line string) {
+	if statsdConf.buf.Len() > 0 && statsdConf.buf.Len()+len(line)+1 > statsdConf.maxSize {
+		statsdConf.flush()
+	}
+	if statsdConf.buf.Len() > 0 {
+		statsdConf.buf.WriteByte('\n')
+	}
+	statsdConf.buf.WriteString(line)
+}
+
+func (statsdConf *StatsdConf) flush() {
+	if statsdConf.buf.Len() == 0 {
+		return
+	}
+	numGauges := int64(bytes.Count(statsdConf.buf.Bytes(), []byte("\n")) + 1)
+	if statsdConf.conn != nil {
+		if _, err := statsdConf.conn.Write(statsdConf.buf.Bytes()); err != nil {
+			statsdConf.errCount++
+			fmt.Printf("statsd write error: %v\n", err)
+			metrics.WriteErrors.Add(1)
+			metrics.PointsFailed.Add(numGauges)
+		} else {
+			metrics.PointsWritten.Add(numGauges)
+		}
+	} else {
+		statsdConf.errCount++
+		metrics.PointsFailed.Add(numGauges)
+	}
+	statsdConf.buf.Reset()
+}
+
+func (statsdConf *StatsdConf) InsertStat(when time.Time, ident string, exporterID string, interval int, statRecord nffile.StatRecord) {
+	var suffix string
+	if statsdConf.timestamp {
+		suffix = fmt.Sprintf("|T%d", when.Unix())
+	}
+
+	channel := sanitize(ident, "_")
+	exporter := sanitize(exporterID, "_")
+	writeProto := func(proto string, flows, packets, octets uint64) {
+		values := [3]uint64{flows, packets, octets}
+		for i, name := range [3]string{"flows", "packets", "bytes"} {
+			var line string
+			if statsdConf.tags {
+				line = fmt.Sprintf("%s:%d|g|#channel:%s,exporter:%s,proto:%s%s",
+					statsdConf.metricName(name), values[i], channel, exporter, proto, suffix)
+			} else {
+				line = fmt.Sprintf("%s:%d|g%s",
+					statsdConf.metricName(strings.ReplaceAll(channel, ".", "_")+"."+exporter+"."+proto+"."+name), values[i], suffix)
+			}
+			statsdConf.gauge(line)
+		}
+	}
+	writeProto("tcp", statRecord.NumflowsTcp, statRecord.NumpacketsTcp, statRecord.NumbytesTcp)
+	writeProto("udp", statRecord.NumflowsUdp, statRecord.NumpacketsUdp, statRecord.NumbytesUdp)
+	writeProto("icmp", statRecord.NumflowsIcmp, statRecord.NumpacketsIcmp, statRecord.NumbytesIcmp)
+	writeProto("other", statRecord.NumflowsOther, statRecord.NumpacketsOther, statRecord.NumbytesOther)
+	if interval > 0 {
+		if statsdConf.tags {
+			statsdConf.gauge(fmt.Sprintf("%s:%d|g|#channel:%s,exporter:%s%s",
+				statsdConf.metricName("interval"), interval, channel, exporter, suffix))
+		} else {
+			statsdConf.gauge(fmt.Sprintf("%s:%d|g%s",
+				statsdConf.metricName(strings.ReplaceAll(channel, ".", "_")+"."+exporter+".interval"), interval, suffix))
+		}
+	}
+	statsdConf.flush()
+}
+
+func (statsdConf *StatsdConf) metricName(name string) string {
+	if len(statsdConf.prefix) > 0 {
+		return statsdConf.prefix + "." + name
+	}
+	return name
+}
+
+func (statsdConf *StatsdConf) EndWrite() error {
+	statsdConf.flush()
+	if statsdConf.errCount > 0 {
+		return fmt.Errorf("statsd failed writes: %d", statsdConf.errCount)
+	}
+	return nil
+}
+
+func (statsdConf *StatsdConf) Close() error {
+	if statsdConf.conn != nil {
+		err := statsdConf.conn.Close()
+		statsdConf.conn = nil
+		return err
+	}
+	return nil
+}